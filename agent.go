@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/invopop/jsonschema"
+)
+
+const (
+	// maxToolResultLength keeps a single page from filling the model's context.
+	maxToolResultLength = 16000
+	// maxTracedResultLength is how much of a tool result is kept in the memory.
+	maxTracedResultLength = 500
+	memorySearchLimit     = 5
+)
+
+type SearchArguments struct {
+	Query string `json:"query" jsonschema:"description=A short web search query"`
+}
+type OpenPageArguments struct {
+	Url string `json:"url" jsonschema:"description=The link of the page to open"`
+}
+type ReadFileArguments struct{}
+type MemorySearchArguments struct {
+	Query string `json:"query" jsonschema:"description=Words to look for in earlier conversations"`
+}
+
+// AgentTool is a tool the agent mode model can call, Arguments is a pointer to
+// the struct its arguments are decoded into and Parameters is the JSON schema
+// of tools that don't have one, like the tools of MCP servers.
+type AgentTool struct {
+	Name        string
+	Description string
+	Arguments   any
+	Parameters  any
+	Run         func(state *State, client *http.Client, arguments json.RawMessage) (string, error)
+}
+
+// agentTools are what agent mode can use, the built in tools are available to
+// every mode.
+var agentTools = append(slices.Clone(builtinTools), webTools...)
+
+var webTools = []AgentTool{
+	{
+		Name:        "web_search",
+		Description: "Search the web, returns result titles, links and snippets",
+		Arguments:   &SearchArguments{},
+		Run: func(state *State, client *http.Client, arguments json.RawMessage) (string, error) {
+			search := SearchArguments{}
+			if err := json.Unmarshal(arguments, &search); err != nil {
+				return "", err
+			}
+			return searxSearch(client, state.Settings.SearxNGUrl, search.Query, 1)
+		},
+	},
+	{
+		Name:        "open_page",
+		Description: "Open a web page, returns the page as markdown",
+		Arguments:   &OpenPageArguments{},
+		Run: func(state *State, client *http.Client, arguments json.RawMessage) (string, error) {
+			page := OpenPageArguments{}
+			if err := json.Unmarshal(arguments, &page); err != nil {
+				return "", err
+			}
+			content := getRequest(client, page.Url)
+			if content == "" {
+				return "", fmt.Errorf("failed to open %s", page.Url)
+			}
+			return content, nil
+		},
+	},
+	{
+		Name:        "read_file",
+		Description: "Read the file the user is asking about",
+		Arguments:   &ReadFileArguments{},
+		Run: func(state *State, client *http.Client, arguments json.RawMessage) (string, error) {
+			if state.FileName == "" {
+				return "", fmt.Errorf("the user didn't give a file")
+			}
+			content, err := readFile(state)
+			return string(content), err
+		},
+	},
+	{
+		Name:        "search_memories",
+		Description: "Search earlier conversations with the user",
+		Arguments:   &MemorySearchArguments{},
+		Run: func(state *State, client *http.Client, arguments json.RawMessage) (string, error) {
+			search := MemorySearchArguments{}
+			if err := json.Unmarshal(arguments, &search); err != nil {
+				return "", err
+			}
+			matches := searchMemories(state, search.Query, memorySearchLimit)
+			if len(matches) == 0 {
+				return "No earlier conversation matched", nil
+			}
+			var found strings.Builder
+			for _, match := range matches {
+				fmt.Fprintf(&found, "[%s]\nUser: %s\nModel: %s\n\n", match.Title, match.Question, match.Answer)
+			}
+			return found.String(), nil
+		},
+	},
+}
+
+func getToolDefinitions(tools []AgentTool) []ToolDefinition {
+	reflector := jsonschema.Reflector{DoNotReference: true, ExpandedStruct: true}
+	definitions := make([]ToolDefinition, 0, len(tools))
+	for _, tool := range tools {
+		parameters := tool.Parameters
+		if parameters == nil {
+			schema := reflector.Reflect(tool.Arguments)
+			schema.Version = ""
+			parameters = schema
+		}
+		definitions = append(definitions, ToolDefinition{
+			Type: "function",
+			Function: ToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  parameters,
+			},
+		})
+	}
+	return definitions
+}
+
+func runAgentTool(state *State, client *http.Client, tools []AgentTool, call OllamaToolCall) string {
+	for _, tool := range tools {
+		if tool.Name != call.Function.Name {
+			continue
+		}
+		result, err := tool.Run(state, client, call.Function.Arguments)
+		if err != nil {
+			state.Logger.Warn("Tool failed", slog.String("tool", tool.Name), slog.Any("err", err))
+			return fmt.Sprintf("Error: %s", err)
+		}
+		if len(result) > maxToolResultLength {
+			result = result[:maxToolResultLength]
+		}
+		return result
+	}
+	return fmt.Sprintf("Error: there is no tool called %s", call.Function.Name)
+}
+
+// runToolCalls runs the tool calls of a message, records them in the state
+// and returns the messages with their results.
+func runToolCalls(state *State, client *http.Client, tools []AgentTool, message ChatMessage) []ChatMessage {
+	var results []ChatMessage
+	for _, call := range message.ToolCalls {
+		fmt.Printf("\nUsing %s %s\n", call.Function.Name, string(call.Function.Arguments))
+		result := runAgentTool(state, client, tools, call)
+		results = append(results, ChatMessage{Role: "tool", Content: result, ToolName: call.Function.Name})
+
+		traced := result
+		if len(traced) > maxTracedResultLength {
+			traced = traced[:maxTracedResultLength] + "..."
+		}
+		state.ToolCalls = append(state.ToolCalls, ToolCall{
+			Name:      call.Function.Name,
+			Arguments: string(call.Function.Arguments),
+			Result:    traced,
+		})
+	}
+	return results
+}
+
+// chatWithTools keeps answering tool calls until the model answers, after
+// Settings.AgentMaxSteps rounds of tool calls it has to answer without them.
+func chatWithTools(state *State, options ModelOptions, timeout time.Duration, messages []ChatMessage, tools []AgentTool, onCall func(call OllamaToolCall)) (*LLMResponse, error) {
+	client := &http.Client{}
+	definitions := getToolDefinitions(tools)
+	answer := &LLMResponse{}
+	for step := 0; ; step++ {
+		if step >= state.Settings.AgentMaxSteps {
+			state.Logger.Info("Ran out of tool calls", slog.Int("steps", step))
+			messages = append(messages, ChatMessage{Role: "user", Content: "You can't use tools anymore, answer the question with what you found."})
+			definitions = nil
+		}
+		ctx, cancelLLM := context.WithTimeout(context.Background(), timeout)
+		response, err := ollamaChat(client, state.Settings.OllamaUrl, messages, definitions, options, ctx)
+		cancelLLM()
+		if err != nil {
+			return answer, err
+		}
+		answer.Model = response.Model
+		answer.PromptEvalCount += response.PromptEvalCount
+		answer.EvalCount += response.EvalCount
+		if len(response.Message.ToolCalls) == 0 || definitions == nil {
+			answer.Response = response.Message.Content
+			return answer, nil
+		}
+
+		messages = append(messages, response.Message)
+		messages = append(messages, runToolCalls(state, client, tools, response.Message)...)
+		if onCall != nil {
+			for _, call := range response.Message.ToolCalls {
+				onCall(call)
+			}
+		}
+	}
+}
+
+// callWithTools is callLLM with the built in tools, models that can't call
+// tools get the same call without them.
+func callWithTools(state *State, options ModelOptions, timeout time.Duration, prompt string, system string) *LLMResponse {
+	messages := []ChatMessage{
+		{Role: "system", Content: system},
+		{Role: "user", Content: prompt},
+	}
+	answer, err := chatWithTools(state, options, timeout, messages, builtinTools, nil)
+	if err != nil {
+		state.Logger.Warn("Failed to call LLM with tools, calling it without them", slog.Any("err", err))
+		state.ToolCalls = nil
+		return callLLM(state, options, timeout, prompt, system, nil)
+	}
+	return answer
+}
+
+// agentMode lets the model search, open pages and read files and memories
+// until it can answer.
+func agentMode(state *State, question string) (*LLMResponse, []string) {
+	state.Logger.Debug("Triggering agent mode")
+	messages := []ChatMessage{
+		{Role: "system", Content: renderPrompt(state, AgentPrompt)},
+		{Role: "user", Content: fmt.Sprintf("[history]\n%s\n[question]\n%s", state.Memory.GetMemoryForModel(), question)},
+	}
+	var sources []string
+	tools := append(slices.Clone(agentTools), getMCPTools(state)...)
+	answer, err := chatWithTools(state, getModelOptions(state, FinalAnswerStage, true), state.Settings.HeavyTimeout, messages, tools, func(call OllamaToolCall) {
+		if call.Function.Name != "open_page" {
+			return
+		}
+		page := OpenPageArguments{}
+		if json.Unmarshal(call.Function.Arguments, &page) == nil && page.Url != "" {
+			sources = append(sources, page.Url)
+		}
+	})
+	if err != nil {
+		state.Logger.Error("Failed to call LLM", slog.Any("err", err))
+	}
+
+	fmt.Printf("\nToken count: %d\n", answer.PromptEvalCount)
+	return answer, sources
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newMemoryId is the memory id of a prompt that starts a new memory.
+const newMemoryId = "new"
+
+type APIPromptRequest struct {
+	Prompt string `json:"prompt" binding:"required"`
+	// Mode and File only apply to this prompt, leave them out to use the
+	// current ones.
+	Mode *string `json:"mode"`
+	File *string `json:"file"`
+	// MemoryId switches to another memory before answering, "new" starts a
+	// new one.
+	MemoryId string `json:"memory_id"`
+}
+
+type APIToolCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+	Result    string `json:"result"`
+}
+
+type APIInteraction struct {
+	Question         string        `json:"question"`
+	Answer           string        `json:"answer"`
+	Sources          []string      `json:"sources"`
+	Mode             string        `json:"mode"`
+	Model            string        `json:"model"`
+	LightModel       string        `json:"light_model,omitempty"`
+	Timestamp        time.Time     `json:"timestamp"`
+	PromptTokens     int           `json:"prompt_tokens"`
+	CompletionTokens int           `json:"completion_tokens"`
+	LatencyMs        int64         `json:"latency_ms"`
+	File             string        `json:"file,omitempty"`
+	ToolCalls        []APIToolCall `json:"tool_calls,omitempty"`
+}
+
+type APIMemory struct {
+	Id           string           `json:"id"`
+	Title        string           `json:"title"`
+	ParentId     string           `json:"parent_id"`
+	Owner        string           `json:"owner"`
+	Tags         []string         `json:"tags"`
+	SharedWith   []string         `json:"shared_with"`
+	Interactions []APIInteraction `json:"interactions"`
+}
+
+type APIPromptResponse struct {
+	MemoryId    string         `json:"memory_id"`
+	Index       int            `json:"index"`
+	Remembered  bool           `json:"remembered"`
+	Interaction APIInteraction `json:"interaction"`
+}
+
+type APISettings struct {
+	Mode       string   `json:"mode"`
+	Profile    string   `json:"profile"`
+	File       string   `json:"file"`
+	Remember   bool     `json:"remember"`
+	MemoryId   string   `json:"memory_id"`
+	User       string   `json:"user"`
+	HeavyModel string   `json:"heavy_model"`
+	LightModel string   `json:"light_model"`
+	Modes      []string `json:"modes"`
+	Profiles   []string `json:"profiles"`
+}
+
+type APISettingsRequest struct {
+	Mode     *string `json:"mode"`
+	Profile  *string `json:"profile"`
+	File     *string `json:"file"`
+	Remember *bool   `json:"remember"`
+	// MemoryId loads another memory, "new" starts a new one.
+	MemoryId *string `json:"memory_id"`
+}
+
+type APIRenameRequest struct {
+	// Title is generated when it is empty.
+	Title string `json:"title"`
+}
+
+func newAPIInteraction(interaction ChatInteraction) APIInteraction {
+	toolCalls := make([]APIToolCall, 0, len(interaction.ToolCalls))
+	for _, call := range interaction.ToolCalls {
+		toolCalls = append(toolCalls, APIToolCall{Name: call.Name, Arguments: call.Arguments, Result: call.Result})
+	}
+	sources := interaction.Links
+	if sources == nil {
+		sources = []string{}
+	}
+	return APIInteraction{
+		Question:         interaction.Question,
+		Answer:           interaction.Answer,
+		Sources:          sources,
+		Mode:             strings.ToLower(interaction.GetModeName()),
+		Model:            interaction.Model,
+		LightModel:       interaction.LightModel,
+		Timestamp:        interaction.Timestamp,
+		PromptTokens:     interaction.PromptEvalCount,
+		CompletionTokens: interaction.EvalCount,
+		LatencyMs:        interaction.Latency.Milliseconds(),
+		File:             displayFileName(interaction.FileName),
+		ToolCalls:        toolCalls,
+	}
+}
+
+func newAPIMemory(state *State, memory Memory) APIMemory {
+	interactions := make([]APIInteraction, 0, len(memory.Interactions))
+	for _, interaction := range memory.Interactions {
+		interactions = append(interactions, newAPIInteraction(interaction))
+	}
+	var owner string
+	state.Database.QueryRow("SELECT owner FROM memories WHERE id=?", memory.Id).Scan(&owner)
+	return APIMemory{
+		Id:           memory.Id,
+		Title:        memory.Title,
+		ParentId:     memory.ParentId,
+		Owner:        owner,
+		Tags:         getMemoryTags(state, memory.Id),
+		SharedWith:   getMemoryShares(state, memory.Id),
+		Interactions: interactions,
+	}
+}
+
+func getAPISettings(state *State) APISettings {
+	modes := make([]string, 0, len(modeRegistry))
+	for _, info := range modeRegistry {
+		modes = append(modes, strings.ToLower(info.Name))
+	}
+	return APISettings{
+		Mode:       strings.ToLower(state.OperatingMode.String()),
+		Profile:    state.Profile,
+		File:       displayFileName(state.FileName),
+		Remember:   state.Remember,
+		MemoryId:   state.Memory.Id,
+		User:       state.User,
+		HeavyModel: state.Settings.HeavyModel,
+		LightModel: state.Settings.LightModel,
+		Modes:      modes,
+		Profiles:   state.Config.ProfileNames(),
+	}
+}
+
+func apiError(c *gin.Context, status int, message string) {
+	c.JSON(status, gin.H{"error": message})
+}
+
+// getAPIMemory returns the current memory if id is its id and reads the
+// memory of the user from the disk otherwise.
+func getAPIMemory(state *State, id string) (Memory, error) {
+	if id == state.Memory.Id && id != "" {
+		return state.Memory, nil
+	}
+	return readUserMemory(state, id)
+}
+
+// switchMemory saves the current memory and makes the memory with id the
+// current one, newMemoryId starts a new memory.
+func switchMemory(state *State, id string) error {
+	if id == state.Memory.Id {
+		return nil
+	}
+	if id == newMemoryId {
+		saveMemory(state)
+		state.Memory = Memory{}
+		return nil
+	}
+	memory, err := readUserMemory(state, id)
+	if err != nil {
+		return err
+	}
+	saveMemory(state)
+	state.Memory = memory
+	return nil
+}
+
+// checkService reports whether a GET of url answers in time.
+func checkService(url string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err.Error()
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err.Error()
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return resp.Status
+	}
+	return "ok"
+}
+
+func registerAPIRoutes(r *gin.RouterGroup) {
+	api := r.Group("/api/v1")
+
+	api.GET("/health", func(c *gin.Context) {
+		state := sessionState(c)
+		ollama := checkService(strings.TrimRight(state.Settings.OllamaUrl, "/") + "/api/tags")
+		searxng := checkService(state.Settings.SearxNGUrl)
+		status := "ok"
+		if ollama != "ok" {
+			status = "degraded"
+		}
+		c.JSON(http.StatusOK, gin.H{"status": status, "ollama": ollama, "searxng": searxng})
+	})
+
+	api.POST("/prompt", func(c *gin.Context) {
+		state := sessionState(c)
+		request := APIPromptRequest{}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		if strings.HasPrefix(request.Prompt, "/") {
+			apiError(c, http.StatusBadRequest, "commands aren't supported, use the other endpoints")
+			return
+		}
+		mode := state.OperatingMode
+		if request.Mode != nil {
+			var ok bool
+			if mode, ok = modeFromName(*request.Mode); !ok {
+				apiError(c, http.StatusBadRequest, fmt.Sprintf("unknown mode %s", *request.Mode))
+				return
+			}
+		}
+		file := state.FileName
+		if request.File != nil {
+			var err error
+			if file, err = resolveFile(state, *request.File); err != nil {
+				apiError(c, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if request.MemoryId != "" {
+			if err := switchMemory(state, request.MemoryId); err != nil {
+				apiError(c, http.StatusNotFound, fmt.Sprintf("memory %s wasn't found", request.MemoryId))
+				return
+			}
+		}
+
+		previousMode, previousFile := state.OperatingMode, state.FileName
+		state.OperatingMode, state.FileName = mode, file
+		answer := executePrompt(state, request.Prompt)
+
+		// The interaction records the mode and file of the request, so they
+		// are only restored once it is built.
+		response := APIPromptResponse{Remembered: state.Remember, Index: -1}
+		if state.Remember {
+			addInteraction(state, request.Prompt, answer)
+			response.Index = len(state.Memory.Interactions) - 1
+			response.Interaction = newAPIInteraction(state.Memory.Interactions[response.Index])
+		} else {
+			response.Interaction = newAPIInteraction(newChatInteraction(state, request.Prompt, answer))
+		}
+		state.OperatingMode, state.FileName = previousMode, previousFile
+		if state.Remember {
+			saveMemory(state)
+			response.MemoryId = state.Memory.Id
+		}
+		c.JSON(http.StatusOK, response)
+	})
+
+	api.GET("/memories", func(c *gin.Context) {
+		state := sessionState(c)
+		memories, err := getMemories(state, c.Query("tag"))
+		if err != nil {
+			state.Logger.Error("Failed to list memories", slog.Any("err", err))
+			apiError(c, http.StatusInternalServerError, "failed to list memories")
+			return
+		}
+		if query := c.Query("q"); query != "" {
+			memories = filterMemories(state, memories, query)
+		}
+		if memories == nil {
+			memories = []MemoryDto{}
+		}
+		c.JSON(http.StatusOK, gin.H{"memories": memories})
+	})
+
+	api.GET("/memories/:id", func(c *gin.Context) {
+		state := sessionState(c)
+		memory, err := getAPIMemory(state, c.Param("id"))
+		if err != nil {
+			apiError(c, http.StatusNotFound, fmt.Sprintf("memory %s wasn't found", c.Param("id")))
+			return
+		}
+		c.JSON(http.StatusOK, newAPIMemory(state, memory))
+	})
+
+	api.GET("/memories/:id/export", func(c *gin.Context) {
+		state := sessionState(c)
+		memory, err := getAPIMemory(state, c.Param("id"))
+		if err != nil {
+			apiError(c, http.StatusNotFound, fmt.Sprintf("memory %s wasn't found", c.Param("id")))
+			return
+		}
+		switch c.DefaultQuery("format", "markdown") {
+		case "markdown":
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.md"`, memory.Id))
+			c.Data(http.StatusOK, "text/markdown; charset=utf-8", []byte(getMemoryMarkdown(memory)))
+		case "json":
+			c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, memory.Id))
+			c.JSON(http.StatusOK, newAPIMemory(state, memory))
+		default:
+			apiError(c, http.StatusBadRequest, "format has to be markdown or json")
+		}
+	})
+
+	api.PATCH("/memories/:id", func(c *gin.Context) {
+		state := sessionState(c)
+		id := c.Param("id")
+		request := APIRenameRequest{}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		memory, err := getAPIMemory(state, id)
+		if err != nil {
+			apiError(c, http.StatusNotFound, fmt.Sprintf("memory %s wasn't found", id))
+			return
+		}
+		if !ownsMemory(state, id) {
+			apiError(c, http.StatusForbidden, sharedReadOnly)
+			return
+		}
+		if id == state.Memory.Id {
+			renameMemory(state, strings.TrimSpace(request.Title))
+			c.JSON(http.StatusOK, newAPIMemory(state, state.Memory))
+			return
+		}
+		// Memories that aren't loaded are renamed without touching the
+		// current one.
+		scratch := *state
+		scratch.Memory = memory
+		renameMemory(&scratch, strings.TrimSpace(request.Title))
+		c.JSON(http.StatusOK, newAPIMemory(state, scratch.Memory))
+	})
+
+	api.DELETE("/memories/:id", func(c *gin.Context) {
+		state := sessionState(c)
+		id := c.Param("id")
+		if !canReadMemory(state, id) {
+			apiError(c, http.StatusNotFound, fmt.Sprintf("memory %s wasn't found", id))
+			return
+		}
+		if err := deleteMemory(state, id); err != nil {
+			apiError(c, http.StatusForbidden, err.Error())
+			return
+		}
+		if id == state.Memory.Id {
+			state.Memory = Memory{}
+		}
+		c.Status(http.StatusNoContent)
+	})
+
+	api.PUT("/memories/:id/shares/:user", func(c *gin.Context) {
+		state := sessionState(c)
+		id := c.Param("id")
+		if !canReadMemory(state, id) {
+			apiError(c, http.StatusNotFound, fmt.Sprintf("memory %s wasn't found", id))
+			return
+		}
+		if !ownsMemory(state, id) {
+			apiError(c, http.StatusForbidden, sharedReadOnly)
+			return
+		}
+		if err := shareMemory(state, id, c.Param("user")); err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"shared_with": getMemoryShares(state, id)})
+	})
+
+	api.DELETE("/memories/:id/shares/:user", func(c *gin.Context) {
+		state := sessionState(c)
+		id := c.Param("id")
+		if !canReadMemory(state, id) {
+			apiError(c, http.StatusNotFound, fmt.Sprintf("memory %s wasn't found", id))
+			return
+		}
+		if err := unshareMemory(state, id, c.Param("user")); err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"shared_with": getMemoryShares(state, id)})
+	})
+
+	api.GET("/settings", func(c *gin.Context) {
+		state := sessionState(c)
+		c.JSON(http.StatusOK, getAPISettings(state))
+	})
+
+	api.PATCH("/settings", func(c *gin.Context) {
+		state := sessionState(c)
+		request := APISettingsRequest{}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		// Everything is checked before anything changes so a bad field
+		// doesn't leave the session half switched.
+		file := state.FileName
+		if request.File != nil {
+			var err error
+			if file, err = resolveFile(state, *request.File); err != nil {
+				apiError(c, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		if request.MemoryId != nil && *request.MemoryId != newMemoryId && *request.MemoryId != state.Memory.Id && !canReadMemory(state, *request.MemoryId) {
+			apiError(c, http.StatusNotFound, fmt.Sprintf("memory %s wasn't found", *request.MemoryId))
+			return
+		}
+		if request.Profile != nil {
+			if !slices.Contains(state.Config.ProfileNames(), *request.Profile) {
+				apiError(c, http.StatusBadRequest, fmt.Sprintf("unknown profile %s", *request.Profile))
+				return
+			}
+			if _, err := state.Config.Settings(*request.Profile); err != nil {
+				apiError(c, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+		var mode OperatingMode
+		if request.Mode != nil {
+			var ok bool
+			if mode, ok = modeFromName(*request.Mode); !ok {
+				apiError(c, http.StatusBadRequest, fmt.Sprintf("unknown mode %s", *request.Mode))
+				return
+			}
+		}
+
+		if request.MemoryId != nil {
+			if err := switchMemory(state, *request.MemoryId); err != nil {
+				apiError(c, http.StatusNotFound, fmt.Sprintf("memory %s wasn't found", *request.MemoryId))
+				return
+			}
+		}
+		// The profile goes first, switching it resets the mode.
+		if request.Profile != nil {
+			switchProfile(state, *request.Profile)
+		}
+		if request.Mode != nil {
+			state.OperatingMode = mode
+		}
+		state.FileName = file
+		if request.Remember != nil {
+			state.Remember = *request.Remember
+		}
+		c.JSON(http.StatusOK, getAPISettings(state))
+	})
+
+	api.GET("/attachments", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"attachments": getSession(c).listAttachments()})
+	})
+
+	api.POST("/attachments", func(c *gin.Context) {
+		session := getSession(c)
+		// The form around the file is allowed a little more than the file.
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAttachmentSize+64<<10)
+		header, err := c.FormFile("file")
+		if err != nil {
+			apiError(c, http.StatusBadRequest, fmt.Sprintf("upload the file in the file field, files can be up to %d MB", maxAttachmentSize>>20))
+			return
+		}
+		file, err := header.Open()
+		if err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer file.Close()
+		if err := session.saveAttachment(header.Filename, file); err != nil {
+			apiError(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		session.State.Logger.Info("Attached upload", slog.String("file", header.Filename), slog.Int64("size", header.Size))
+		c.JSON(http.StatusOK, gin.H{"attachments": session.listAttachments()})
+	})
+
+	api.POST("/attachments/:name/attach", func(c *gin.Context) {
+		session := getSession(c)
+		if err := session.attach(c.Param("name")); err != nil {
+			apiError(c, http.StatusNotFound, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"attachments": session.listAttachments()})
+	})
+
+	api.DELETE("/attachments/:name", func(c *gin.Context) {
+		session := getSession(c)
+		if err := session.deleteAttachment(c.Param("name")); err != nil {
+			apiError(c, http.StatusNotFound, err.Error())
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"attachments": session.listAttachments()})
+	})
+}
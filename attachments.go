@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+const uploadsDirectoryName string = ".uploads"
+
+// maxAttachmentSize keeps attachments to what fits in the context of a model.
+const maxAttachmentSize = 5 << 20
+
+// Attachment is a file uploaded to a session, the attached one is the [file]
+// context of the prompts.
+type Attachment struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Attached bool   `json:"attached"`
+}
+
+func uploadsDirectory(dataDir string) string {
+	return filepath.Join(dataDir, uploadsDirectoryName)
+}
+
+// removeStaleUploads removes the uploads of sessions that didn't end because
+// the web server was killed.
+func removeStaleUploads(dataDir string) error {
+	return os.RemoveAll(uploadsDirectory(dataDir))
+}
+
+// attachmentName is the name an upload is stored under, it can't leave the
+// upload directory of the session.
+func attachmentName(name string) (string, error) {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("bad file name %s", name)
+	}
+	return name, nil
+}
+
+func (self *Session) attachmentPath(name string) (string, error) {
+	name, err := attachmentName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(self.UploadDir, name), nil
+}
+
+func (self *Session) listAttachments() []Attachment {
+	attachments := []Attachment{}
+	entries, err := os.ReadDir(self.UploadDir)
+	if err != nil {
+		return attachments
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		path := filepath.Join(self.UploadDir, entry.Name())
+		size := info.Size() - int64(self.State.Cipher.Overhead())
+		attachments = append(attachments, Attachment{Name: entry.Name(), Size: size, Attached: path == self.State.FileName})
+	}
+	return attachments
+}
+
+// saveAttachment stores an upload and attaches it, only text files fit in a
+// prompt so anything else is refused.
+func (self *Session) saveAttachment(name string, content io.Reader) error {
+	path, err := self.attachmentPath(name)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(io.LimitReader(content, maxAttachmentSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxAttachmentSize {
+		return fmt.Errorf("files can be up to %d MB", maxAttachmentSize>>20)
+	}
+	if !utf8.Valid(data) || slices.Contains(data, 0) {
+		return errors.New("only text files can be attached")
+	}
+	if err := os.MkdirAll(self.UploadDir, 0700); err != nil {
+		return err
+	}
+	// Uploads are encrypted like the memories, pasted code shouldn't sit on
+	// the disk in plaintext when the store is encrypted.
+	if err := os.WriteFile(path, self.State.Cipher.Seal(data), 0600); err != nil {
+		return err
+	}
+	self.State.FileName = path
+	return nil
+}
+
+func (self *Session) attach(name string) error {
+	path, err := self.attachmentPath(name)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("there is no attachment %s", name)
+	}
+	self.State.FileName = path
+	return nil
+}
+
+func (self *Session) deleteAttachment(name string) error {
+	path, err := self.attachmentPath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("there is no attachment %s", name)
+	}
+	if self.State.FileName == path {
+		self.State.FileName = ""
+	}
+	return nil
+}
+
+// removeAttachments deletes the uploads of the session when it ends.
+func (self *Session) removeAttachments() {
+	if err := os.RemoveAll(self.UploadDir); err != nil {
+		self.State.Logger.Warn("Failed to remove uploads", slog.Any("err", err))
+	}
+	if strings.HasPrefix(self.State.FileName, self.UploadDir) {
+		self.State.FileName = ""
+	}
+}
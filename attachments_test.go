@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestAttachmentName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"notes.txt", "notes.txt"},
+		{"report 2026.pdf", "report 2026.pdf"},
+		{"../../etc/passwd", "passwd"},
+		{"/etc/passwd", "passwd"},
+		{"dir/sub/main.go", "main.go"},
+		{`C:\Users\bob\notes.txt`, "notes.txt"},
+		{`..\..\notes.txt`, "notes.txt"},
+		{"notes.txt/", "notes.txt"},
+	}
+	for _, test := range tests {
+		got, err := attachmentName(test.name)
+		if err != nil {
+			t.Errorf("attachmentName(%q) returned error %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("attachmentName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAttachmentNameErrors(t *testing.T) {
+	tests := []string{
+		"",
+		".",
+		"..",
+		"/",
+		`\`,
+		"../",
+		".env",
+		"dir/.hidden",
+		`dir\.hidden`,
+	}
+	for _, name := range tests {
+		if got, err := attachmentName(name); err == nil {
+			t.Errorf("attachmentName(%q) = %q, want an error", name, got)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/term"
+)
+
+const csrfField = "csrf_token"
+const csrfHeader = "X-CSRF-Token"
+
+// userContextKey is where RequireAuthorization puts the user of a request.
+const userContextKey = "user"
+
+// Auth decides who can use the web server. It is enabled once there is a
+// user account in the database or a shared token.
+type Auth struct {
+	Database *sql.DB
+	Token    string
+	Logger   *slog.Logger
+}
+
+func getPassword() string {
+	if password := os.Getenv("YAAP_PASSWORD"); password != "" {
+		return password
+	}
+	fmt.Fprint(os.Stderr, "Password: ")
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		panic("failed to read password: " + err.Error())
+	}
+	return string(password)
+}
+
+func addUser(db *sql.DB, name string, password string) error {
+	if password == "" {
+		return errors.New("the password can't be empty")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		`INSERT INTO users (name, password_hash) VALUES (?, ?)
+		 ON CONFLICT (name) DO UPDATE SET password_hash = excluded.password_hash`,
+		name, string(hash),
+	)
+	return err
+}
+
+func userExists(db *sql.DB, name string) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM users WHERE name = ?", name).Scan(&count)
+	return count > 0
+}
+
+func deleteUser(db *sql.DB, name string) error {
+	result, err := db.Exec("DELETE FROM users WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+	if deleted, _ := result.RowsAffected(); deleted == 0 {
+		return fmt.Errorf("there is no user %s", name)
+	}
+	_, err = db.Exec("DELETE FROM memory_shares WHERE user = ?", name)
+	return err
+}
+
+func (self *Auth) hasUsers() bool {
+	var count int
+	if err := self.Database.QueryRow("SELECT COUNT(*) FROM users").Scan(&count); err != nil {
+		self.Logger.Error("Failed to count users", slog.Any("err", err))
+		// Failing closed keeps the server locked when the database is broken.
+		return true
+	}
+	return count > 0
+}
+
+func (self *Auth) Enabled() bool {
+	return self.Token != "" || self.hasUsers()
+}
+
+func (self *Auth) checkPassword(name string, password string) bool {
+	var hash string
+	err := self.Database.QueryRow("SELECT password_hash FROM users WHERE name = ?", name).Scan(&hash)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			self.Logger.Error("Failed to read user", slog.Any("err", err))
+		}
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (self *Auth) checkToken(token string) bool {
+	return self.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(self.Token)) == 1
+}
+
+// login checks a name and password, an empty name logs in with the shared
+// token as the password.
+func (self *Auth) login(name string, password string) bool {
+	if name == "" {
+		return self.checkToken(password)
+	}
+	return self.checkPassword(name, password)
+}
+
+// checkAuthorization logs in with the Authorization header, either basic auth
+// with a user account or a bearer token that is the shared token or
+// "<user>:<password>" for clients that only take an API key.
+func (self *Auth) checkAuthorization(c *gin.Context) (string, bool) {
+	if name, password, ok := c.Request.BasicAuth(); ok {
+		return name, self.checkPassword(name, password)
+	}
+	token, found := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !found {
+		return "", false
+	}
+	if self.checkToken(token) {
+		return "", true
+	}
+	if name, password, found := strings.Cut(token, ":"); found {
+		return name, self.checkPassword(name, password)
+	}
+	return "", false
+}
+
+func wantsHTML(c *gin.Context) bool {
+	return c.Request.Method == http.MethodGet && strings.Contains(c.GetHeader("Accept"), "text/html")
+}
+
+func isSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// validCSRFToken checks the CSRF token of a form or of the header fetch
+// requests send.
+func validCSRFToken(c *gin.Context, session *Session) bool {
+	token := c.GetHeader(csrfHeader)
+	if token == "" {
+		token = c.PostForm(csrfField)
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(session.CSRFToken)) == 1
+}
+
+// Middleware keeps sessions that aren't logged in out and checks the CSRF
+// token of requests that rely on the session cookie.
+func (self *Auth) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session := getSession(c)
+		authorized := c.GetHeader("Authorization") != ""
+		if self.Enabled() && !session.LoggedIn {
+			user, ok := self.checkAuthorization(c)
+			if !ok {
+				if wantsHTML(c) {
+					c.Redirect(http.StatusSeeOther, webPath(c, "/login"))
+				} else {
+					c.Header("WWW-Authenticate", `Basic realm="YAAP"`)
+					apiError(c, http.StatusUnauthorized, "log in first")
+				}
+				c.Abort()
+				return
+			}
+			session.logIn(user)
+		}
+
+		if !isSafeMethod(c.Request.Method) && c.GetBool(sessionCookieContextKey) && !authorized {
+			if !validCSRFToken(c, session) {
+				self.Logger.Warn("Rejected request with a bad CSRF token", slog.String("path", c.FullPath()))
+				c.String(http.StatusForbidden, "Bad CSRF token, reload the page")
+				c.Abort()
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// RequireAuthorization protects routes without sessions, which can only log
+// in with the Authorization header. The user it logged in is kept in the
+// context under userContextKey.
+func (self *Auth) RequireAuthorization() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !self.Enabled() {
+			c.Next()
+			return
+		}
+		user, ok := self.checkAuthorization(c)
+		if !ok {
+			c.Header("WWW-Authenticate", `Basic realm="YAAP"`)
+			openAIError(c, http.StatusUnauthorized, "invalid_api_key", "Log in with basic auth or use the token as the API key")
+			c.Abort()
+			return
+		}
+		c.Set(userContextKey, user)
+		c.Next()
+	}
+}
+
+// registerLoginRoutes adds the login and logout pages, they sit behind the
+// session middleware but not the auth middleware.
+func registerLoginRoutes(r *gin.RouterGroup, auth *Auth, sessions *SessionManager) {
+	r.GET("/login", func(c *gin.Context) {
+		session := getSession(c)
+		if session.LoggedIn || !auth.Enabled() {
+			c.Redirect(http.StatusSeeOther, webPath(c, "/"))
+			return
+		}
+		c.HTML(http.StatusOK, "login.html", gin.H{"csrfToken": session.CSRFToken, "token": auth.Token != ""})
+	})
+	r.POST("/login", func(c *gin.Context) {
+		session := getSession(c)
+		if !validCSRFToken(c, session) {
+			c.String(http.StatusForbidden, "Bad CSRF token, reload the page")
+			return
+		}
+		name := strings.TrimSpace(c.PostForm("name"))
+		if !auth.login(name, c.PostForm("password")) {
+			auth.Logger.Warn("Failed login", slog.String("user", name), slog.String("ip", c.ClientIP()))
+			c.HTML(http.StatusUnauthorized, "login.html", gin.H{"csrfToken": session.CSRFToken, "token": auth.Token != "", "error": "Wrong user or password"})
+			return
+		}
+		auth.Logger.Info("Logged in", slog.String("user", name))
+		sessions.Renew(session)
+		session.logIn(name)
+		setSessionCookie(c, session)
+		c.Redirect(http.StatusSeeOther, webPath(c, "/"))
+	})
+	r.POST("/logout", func(c *gin.Context) {
+		session := getSession(c)
+		if !validCSRFToken(c, session) {
+			c.String(http.StatusForbidden, "Bad CSRF token, reload the page")
+			return
+		}
+		saveMemory(session.State)
+		session.removeAttachments()
+		sessions.forget(session.Id)
+		c.SetCookie(sessionCookie, "", -1, cookiePath(c), "", isSecureRequest(c), true)
+		c.Redirect(http.StatusSeeOther, webPath(c, "/login"))
+	})
+}
+
+// isLoopback reports whether a listen address only accepts local connections.
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckAuthorization(t *testing.T) {
+	db := initDb(t.TempDir())
+	defer db.Close()
+	if err := addUser(db, "alice", "secret"); err != nil {
+		t.Fatalf("addUser returned error %v", err)
+	}
+	auth := &Auth{Database: db, Token: "shared-token", Logger: slog.New(slog.DiscardHandler)}
+	basic := func(credentials string) string {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantUser      string
+		wantOk        bool
+	}{
+		{"basic auth", basic("alice:secret"), "alice", true},
+		{"basic auth with a wrong password", basic("alice:wrong"), "alice", false},
+		{"basic auth with an unknown user", basic("bob:secret"), "bob", false},
+		{"shared token", "Bearer shared-token", "", true},
+		{"wrong token", "Bearer other-token", "", false},
+		{"user and password as token", "Bearer alice:secret", "alice", true},
+		{"user and wrong password as token", "Bearer alice:wrong", "alice", false},
+		{"token without bearer", "shared-token", "", false},
+		{"no header", "", "", false},
+	}
+	for _, test := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/settings", nil)
+		if test.authorization != "" {
+			c.Request.Header.Set("Authorization", test.authorization)
+		}
+		user, ok := auth.checkAuthorization(c)
+		if user != test.wantUser || ok != test.wantOk {
+			t.Errorf("%s: checkAuthorization = %q, %v, want %q, %v", test.name, user, ok, test.wantUser, test.wantOk)
+		}
+	}
+}
+
+func TestCheckAuthorizationWithoutToken(t *testing.T) {
+	db := initDb(t.TempDir())
+	defer db.Close()
+	auth := &Auth{Database: db, Logger: slog.New(slog.DiscardHandler)}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/api/v1/settings", nil)
+	c.Request.Header.Set("Authorization", "Bearer ")
+	if user, ok := auth.checkAuthorization(c); ok {
+		t.Errorf("checkAuthorization with an empty token = %q, %v, want false", user, ok)
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"127.1.2.3:8080", true},
+		{"localhost:8080", true},
+		{"[::1]:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"[::]:8080", false},
+		{"192.168.1.10:8080", false},
+		{"example.com:8080", false},
+		{"127.0.0.1", false},
+	}
+	for _, test := range tests {
+		if got := isLoopback(test.address); got != test.want {
+			t.Errorf("isLoopback(%q) = %v, want %v", test.address, got, test.want)
+		}
+	}
+}
@@ -3,14 +3,86 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/charmbracelet/glamour"
 )
 
 type ChatInteraction struct {
-	Question string
-	Answer   string
-	Links    []string
+	Question        string
+	Answer          string
+	Links           []string
+	Mode            OperatingMode
+	RoutedMode      OperatingMode
+	Model           string
+	LightModel      string
+	Timestamp       time.Time
+	PromptEvalCount int
+	EvalCount       int
+	Latency         time.Duration
+	FileName        string
+	ToolCalls       []ToolCall
+	// ModeName and RoutedModeName find custom modes again, their values
+	// change when the config does.
+	ModeName       string
+	RoutedModeName string
+}
+
+// ToolCall is a tool the agent mode called while answering.
+type ToolCall struct {
+	Name      string
+	Arguments string
+	Result    string
+}
+
+func (self ChatInteraction) GetMetadata() string {
+	if self.Timestamp.IsZero() {
+		return ""
+	}
+	metadata := fmt.Sprintf(
+		"%s | %s | %s (light: %s) | tokens: %d in, %d out | %s",
+		self.Timestamp.In(time.Local).Format("2006-01-02 15:04:05"),
+		self.GetModeName(),
+		self.Model,
+		self.LightModel,
+		self.PromptEvalCount,
+		self.EvalCount,
+		self.Latency.Round(time.Second),
+	)
+	if self.FileName != "" {
+		metadata += fmt.Sprintf(" | file: %s", self.FileName)
+	}
+	return metadata
+}
+
+// GetMode finds the mode the interaction was answered with, interactions
+// saved before mode names were stored only know the built in modes.
+func (self ChatInteraction) GetMode() (OperatingMode, bool) {
+	if self.ModeName != "" {
+		return modeByName(self.ModeName)
+	}
+	if self.Mode >= 0 && int(self.Mode) < builtinModeCount {
+		return self.Mode, true
+	}
+	return self.Mode, false
+}
+
+func storedModeName(mode OperatingMode, name string) string {
+	if name != "" {
+		return name
+	}
+	if mode >= 0 && int(mode) < builtinModeCount {
+		return mode.String()
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", int(mode))
+}
+
+func (self ChatInteraction) GetModeName() string {
+	name := storedModeName(self.Mode, self.ModeName)
+	if name == Auto.String() {
+		return fmt.Sprintf("%s -> %s", name, storedModeName(self.RoutedMode, self.RoutedModeName))
+	}
+	return name
 }
 
 func (self ChatInteraction) GetTags() string {
@@ -23,6 +95,7 @@ func (self ChatInteraction) GetTags() string {
 type Memory struct {
 	Title        string
 	Id           string
+	ParentId     string
 	Interactions []ChatInteraction
 }
 
@@ -38,17 +111,32 @@ func (self Memory) GetPrintedMemory(renderer *glamour.TermRenderer) string {
 
 	var history strings.Builder
 	for _, interaction := range self.Interactions {
-		fmt.Fprintf(&history, ">>>> %s\n\n", interaction.Question)
-		out, err := renderer.Render(interaction.Answer)
-		if err != nil {
-			fmt.Fprintf(&history, "LLM: \n\n%s\n\n", interaction.Answer)
-		} else {
-			fmt.Fprintf(&history, "LLM: \n\n%s\n\n", out)
-		}
-
-		fmt.Fprintf(&history, "Links: \n%s", strings.Join(interaction.Links, "\n"))
+		fmt.Fprintf(&history, "%s", interaction.GetPrinted(renderer))
 	}
 
 	return history.String()
 
 }
+func (self ChatInteraction) GetPrinted(renderer *glamour.TermRenderer) string {
+	var printed strings.Builder
+	fmt.Fprintf(&printed, ">>>> %s\n\n", self.Question)
+	if metadata := self.GetMetadata(); metadata != "" {
+		fmt.Fprintf(&printed, "%s\n\n", metadata)
+	}
+	for _, call := range self.ToolCalls {
+		fmt.Fprintf(&printed, "Tool %s %s\n", call.Name, call.Arguments)
+	}
+	if len(self.ToolCalls) > 0 {
+		fmt.Fprintf(&printed, "\n")
+	}
+	out, err := renderer.Render(self.Answer)
+	if err != nil {
+		fmt.Fprintf(&printed, "LLM: \n\n%s\n\n", self.Answer)
+	} else {
+		fmt.Fprintf(&printed, "LLM: \n\n%s\n\n", out)
+	}
+
+	fmt.Fprintf(&printed, "Links: \n%s", strings.Join(self.Links, "\n"))
+
+	return printed.String()
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profile is a named set of settings from the config file. Zero values are
+// left out so a profile only has to mention what it changes.
+type Profile struct {
+	HeavyModel       string        `yaml:"heavy_model"`
+	LightModel       string        `yaml:"light_model"`
+	OllamaUrl        string        `yaml:"ollama_url"`
+	SearxNGUrl       string        `yaml:"searxng_url"`
+	DefaultMode      string        `yaml:"default_mode"`
+	LightTimeout     time.Duration `yaml:"light_timeout"`
+	HeavyTimeout     time.Duration `yaml:"heavy_timeout"`
+	LightTemperature *float64      `yaml:"light_temperature"`
+	HeavyTemperature *float64      `yaml:"heavy_temperature"`
+	Concurrency      int           `yaml:"concurrency"`
+	AgentMaxSteps    int           `yaml:"agent_max_steps"`
+	// Modes maps a mode name, or "default" for every mode, to the model
+	// options of its stages.
+	Modes map[string]map[string]ModelOptions `yaml:"modes"`
+}
+
+func (self Profile) Apply(settings *Settings) error {
+	if self.HeavyModel != "" {
+		settings.HeavyModel = self.HeavyModel
+	}
+	if self.LightModel != "" {
+		settings.LightModel = self.LightModel
+	}
+	if self.OllamaUrl != "" {
+		settings.OllamaUrl = self.OllamaUrl
+	}
+	if self.SearxNGUrl != "" {
+		settings.SearxNGUrl = self.SearxNGUrl
+	}
+	if self.DefaultMode != "" {
+		mode, ok := modeFromName(self.DefaultMode)
+		if !ok {
+			return fmt.Errorf("unknown default mode %s", self.DefaultMode)
+		}
+		settings.DefaultMode = mode
+	}
+	if self.LightTimeout > 0 {
+		settings.LightTimeout = self.LightTimeout
+	}
+	if self.HeavyTimeout > 0 {
+		settings.HeavyTimeout = self.HeavyTimeout
+	}
+	if self.LightTemperature != nil {
+		settings.LightTemperature = *self.LightTemperature
+	}
+	if self.HeavyTemperature != nil {
+		settings.HeavyTemperature = *self.HeavyTemperature
+	}
+	if self.Concurrency > 0 {
+		settings.Concurrency = self.Concurrency
+	}
+	if self.AgentMaxSteps < 0 {
+		return fmt.Errorf("agent_max_steps has to be at least 1")
+	}
+	if self.AgentMaxSteps > 0 {
+		settings.AgentMaxSteps = self.AgentMaxSteps
+	}
+	if len(self.Modes) > 0 {
+		defaultStages := maps.Clone(settings.DefaultStages)
+		modeStages := make(map[OperatingMode]map[Stage]ModelOptions, len(settings.Stages))
+		for mode, options := range settings.Stages {
+			modeStages[mode] = maps.Clone(options)
+		}
+		for modeName, stageOptions := range self.Modes {
+			var target map[Stage]ModelOptions
+			if modeName == "default" {
+				if defaultStages == nil {
+					defaultStages = make(map[Stage]ModelOptions)
+				}
+				target = defaultStages
+			} else {
+				mode, ok := modeFromName(modeName)
+				if !ok {
+					return fmt.Errorf("unknown mode %s", modeName)
+				}
+				if modeStages[mode] == nil {
+					modeStages[mode] = make(map[Stage]ModelOptions)
+				}
+				target = modeStages[mode]
+			}
+			for stageName, options := range stageOptions {
+				stage, ok := stageFromName(stageName)
+				if !ok {
+					return fmt.Errorf("unknown stage %s of mode %s", stageName, modeName)
+				}
+				target[stage] = target[stage].Apply(options)
+			}
+		}
+		settings.DefaultStages = defaultStages
+		settings.Stages = modeStages
+	}
+	return nil
+}
+
+type Config struct {
+	DefaultProfile string             `yaml:"default_profile"`
+	Profiles       map[string]Profile `yaml:"profiles"`
+	// CustomModes are modes declared as a pipeline of steps, by name.
+	CustomModes map[string]CustomMode `yaml:"custom_modes"`
+	// MCPServers are the MCP servers whose tools agent mode can use, by name.
+	MCPServers map[string]MCPServer `yaml:"mcp_servers"`
+	// base holds the settings before any profile is applied and overrides
+	// holds what was given on the command line or in environment variables,
+	// which always wins over the profile.
+	base      Settings
+	overrides Profile
+}
+
+func defaultConfigPath() string {
+	return filepath.Join(xdgDir("XDG_CONFIG_HOME", ".config"), "config.yaml")
+}
+
+// loadConfig reads the config file at path, a missing file is an empty config.
+func loadConfig(path string, base Settings, overrides Profile) (Config, error) {
+	config := Config{base: base, overrides: overrides}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return config, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	for name, server := range config.MCPServers {
+		if err := server.Validate(); err != nil {
+			return config, fmt.Errorf("mcp server %s: %w", name, err)
+		}
+	}
+	return config, nil
+}
+
+// Settings resolves the settings of a profile, an empty name resolves the
+// default profile or just the base settings if the config has none.
+func (self Config) Settings(profileName string) (Settings, error) {
+	settings := self.base
+	if profileName == "" {
+		profileName = self.DefaultProfile
+	}
+	if profileName != "" {
+		profile, ok := self.Profiles[profileName]
+		if !ok {
+			return settings, fmt.Errorf("profile %s doesn't exist", profileName)
+		}
+		if err := profile.Apply(&settings); err != nil {
+			return settings, fmt.Errorf("profile %s: %w", profileName, err)
+		}
+	}
+	err := self.overrides.Apply(&settings)
+	return settings, err
+}
+
+func (self Config) ProfileNames() []string {
+	names := make([]string, 0, len(self.Profiles))
+	for name := range self.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+func switchProfile(state *State, profileName string) string {
+	settings, err := state.Config.Settings(profileName)
+	if err != nil {
+		return err.Error()
+	}
+	state.Settings = settings
+	state.Profile = profileName
+	state.OperatingMode = settings.DefaultMode
+	return fmt.Sprintf("Switched to profile %s", profileName)
+}
+
+func listProfiles(state *State) string {
+	var profiles strings.Builder
+	fmt.Fprintf(&profiles, "Profiles\n\n")
+	for _, name := range state.Config.ProfileNames() {
+		if name == state.Profile {
+			fmt.Fprintf(&profiles, "* %s\n\n", name)
+			continue
+		}
+		fmt.Fprintf(&profiles, "%s\n\n", name)
+	}
+	return profiles.String()
+}
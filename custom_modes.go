@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/invopop/jsonschema"
+)
+
+const (
+	GenerateQueriesStep string = "generate_queries"
+	SearchStep          string = "search"
+	PickLinksStep       string = "pick_links"
+	FetchStep           string = "fetch"
+	ExtractStep         string = "extract"
+	FinalAnswerStep     string = "final_answer"
+)
+
+// pipelineSteps is the order steps have to appear in, each step works on the
+// output of the step before it.
+var pipelineSteps = []string{GenerateQueriesStep, SearchStep, PickLinksStep, FetchStep, ExtractStep, FinalAnswerStep}
+
+// defaultStepPrompts are the prompts steps use when the config doesn't name one.
+var defaultStepPrompts = map[string]string{
+	GenerateQueriesStep: LinkQueriesPrompt,
+	PickLinksStep:       LinkSelectionPrompt,
+	ExtractStep:         ResearchExtractPrompt,
+	FinalAnswerStep:     ResearchAnswerPrompt,
+}
+
+type PipelineStep struct {
+	Step         string `yaml:"step"`
+	Prompt       string `yaml:"prompt"`
+	ModelOptions `yaml:",inline"`
+}
+
+type CustomMode struct {
+	Flag        string         `yaml:"flag"`
+	Description string         `yaml:"description"`
+	Pipeline    []PipelineStep `yaml:"pipeline"`
+}
+
+// Validate checks the steps of the pipeline and that their prompts exist in
+// promptsDir or are built in.
+func (self CustomMode) Validate(promptsDir string) error {
+	if len(self.Pipeline) == 0 || self.Pipeline[len(self.Pipeline)-1].Step != FinalAnswerStep {
+		return fmt.Errorf("the pipeline has to end with %s", FinalAnswerStep)
+	}
+	previous := -1
+	for _, step := range self.Pipeline {
+		index := slices.Index(pipelineSteps, step.Step)
+		if index == -1 {
+			return fmt.Errorf("unknown step %s, steps are %s", step.Step, strings.Join(pipelineSteps, ", "))
+		}
+		if index <= previous {
+			return fmt.Errorf("step %s has to come before %s", step.Step, pipelineSteps[previous])
+		}
+		if index > 0 && index < slices.Index(pipelineSteps, FinalAnswerStep) && index != previous+1 {
+			return fmt.Errorf("step %s needs %s right before it", step.Step, pipelineSteps[index-1])
+		}
+		if prompt := step.PromptName(); prompt != "" && !promptExists(promptsDir, prompt) {
+			return fmt.Errorf("step %s: there is no prompt %s in %s", step.Step, prompt, promptsDir)
+		}
+		previous = index
+	}
+	return nil
+}
+
+func (self PipelineStep) PromptName() string {
+	if self.Prompt != "" {
+		return self.Prompt
+	}
+	return defaultStepPrompts[self.Step]
+}
+
+// registerCustomModes adds the modes declared in the config to the mode
+// registry, their prompts are looked for in promptsDir.
+func registerCustomModes(config Config, promptsDir string) error {
+	names := make([]string, 0, len(config.CustomModes))
+	for name := range config.CustomModes {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		mode := config.CustomModes[name]
+		if _, exists := modeFromName(name); exists {
+			return fmt.Errorf("mode %s already exists", name)
+		}
+		if _, exists := modeFromFlag(mode.Flag); exists {
+			return fmt.Errorf("mode %s: flag %s is already used", name, mode.Flag)
+		}
+		if err := mode.Validate(promptsDir); err != nil {
+			return fmt.Errorf("mode %s: %w", name, err)
+		}
+
+		var modePrompts []string
+		for _, step := range mode.Pipeline {
+			if prompt := step.PromptName(); prompt != "" {
+				modePrompts = append(modePrompts, prompt)
+			}
+		}
+		description := mode.Description
+		if description == "" {
+			description = fmt.Sprintf("custom mode (%s)", name)
+		}
+		pipeline := mode.Pipeline
+		registerMode(ModeInfo{
+			Name:        strings.ToUpper(name),
+			Flag:        mode.Flag,
+			Description: description,
+			Status:      fmt.Sprintf("Running %s!", name),
+			Prompts:     modePrompts,
+			Run: func(state *State, question string) (*LLMResponse, []string) {
+				return runPipeline(state, question, pipeline)
+			},
+		})
+	}
+	return nil
+}
+
+func runPipeline(state *State, question string, pipeline []PipelineStep) (*LLMResponse, []string) {
+	state.Logger.Debug("Triggering custom mode", slog.String("mode", state.OperatingMode.String()))
+	client := &http.Client{}
+	var queries, links, pages []string
+	context := ""
+	finalAnswer := &LLMResponse{}
+
+	for _, step := range pipeline {
+		switch step.Step {
+		case GenerateQueriesStep:
+			options := getModelOptions(state, QueryGeneration, false).Apply(step.ModelOptions)
+			answer := callLLM(state, options, state.Settings.LightTimeout, buildPrompt(state, question, ""), renderPrompt(state, step.PromptName()), jsonschema.Reflect(&QueriesList{}))
+			queriesList := &QueriesList{}
+			json.Unmarshal([]byte(answer.Response), queriesList)
+			queries = queriesList.Queries
+		case SearchStep:
+			var results strings.Builder
+			for _, line := range queries {
+				query := strings.TrimSpace(line)
+				if query == "" {
+					continue
+				}
+				result, err := searxSearch(client, state.Settings.SearxNGUrl, query, 1)
+				if err != nil {
+					state.Logger.Warn("Search failed", slog.String("query", query), slog.Any("err", err))
+					continue
+				}
+				fmt.Fprintf(&results, "Original query: %s\n\nAnswer:%s\n\n", query, result)
+			}
+			context = results.String()
+		case PickLinksStep:
+			options := getModelOptions(state, LinkSelection, false).Apply(step.ModelOptions)
+			answer := callLLM(state, options, state.Settings.LightTimeout, buildPrompt(state, question, context), renderPrompt(state, step.PromptName()), jsonschema.Reflect(&LinksList{}))
+			linksList := &LinksList{}
+			json.Unmarshal([]byte(answer.Response), linksList)
+			for _, link := range linksList.Links {
+				if trimmed := strings.TrimSpace(link); trimmed != "" {
+					links = append(links, trimmed)
+				}
+			}
+		case FetchStep:
+			pages = forEachConcurrently(state, links, func(link string) string {
+				return getRequest(client, link)
+			})
+			context = strings.Join(pages, "\n\n")
+		case ExtractStep:
+			options := getModelOptions(state, Summarization, false).Apply(step.ModelOptions)
+			system := renderPrompt(state, step.PromptName())
+			extracts := forEachConcurrently(state, pages, func(page string) string {
+				return callLLM(state, options, state.Settings.LightTimeout, fmt.Sprintf(`
+				[web page]
+				%s
+				[question]
+				%s
+				[prompt]
+				Please get relavant information for the question from the web page
+				`, page, question), system, nil).Response
+			})
+			context = strings.Join(extracts, "\n\n")
+		case FinalAnswerStep:
+			options := getModelOptions(state, FinalAnswerStage, true).Apply(step.ModelOptions)
+			finalAnswer = callWithTools(state, options, state.Settings.HeavyTimeout, buildPrompt(state, question, context), renderPrompt(state, step.PromptName()))
+		}
+	}
+
+	fmt.Printf("\nToken count: %d\n", finalAnswer.PromptEvalCount)
+
+	return finalAnswer, links
+}
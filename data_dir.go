@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const projectDataDirName string = ".yaap"
+
+func xdgDir(variable string, fallback ...string) string {
+	if dir := os.Getenv(variable); dir != "" {
+		return filepath.Join(dir, "yaap")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return projectDataDirName
+	}
+	return filepath.Join(append(append([]string{home}, fallback...), "yaap")...)
+}
+
+func defaultDataDir() string {
+	return xdgDir("XDG_DATA_HOME", ".local", "share")
+}
+
+// findProjectDataDir looks for a project store in start and its parents,
+// a project opts in to its own memories by having a .yaap directory.
+func findProjectDataDir(start string) string {
+	dir := start
+	for {
+		candidate := filepath.Join(dir, projectDataDirName)
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// resolveDataDir picks where memories and logs are stored, in order: an
+// explicit directory, a new project store in the working directory, an
+// existing project store, and the XDG data directory.
+func resolveDataDir(explicit string, project bool) (string, error) {
+	dir := explicit
+	if dir == "" {
+		workingDirectory, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		if project {
+			dir = filepath.Join(workingDirectory, projectDataDirName)
+		} else if projectDir := findProjectDataDir(workingDirectory); projectDir != "" {
+			dir = projectDir
+		} else {
+			dir = defaultDataDir()
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// migrateLegacyStore moves the memories older versions kept in the working
+// directory into dataDir, as long as dataDir doesn't have memories of its own.
+// It reports whether there was a store to move.
+func migrateLegacyStore(dataDir string) (bool, error) {
+	workingDirectory, err := os.Getwd()
+	if err != nil {
+		return false, err
+	}
+	legacyDb := filepath.Join(workingDirectory, memoriesDbName)
+	if _, err := os.Stat(legacyDb); err != nil {
+		return false, nil
+	}
+	if same, err := sameDirectory(workingDirectory, dataDir); err != nil || same {
+		return false, err
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, memoriesDbName)); err == nil {
+		return true, fmt.Errorf("%s already has memories", dataDir)
+	}
+	legacyMemories := filepath.Join(workingDirectory, memoriesDirectoryName)
+	if _, err := os.Stat(legacyMemories); err == nil {
+		if _, err := os.Stat(memoriesDirectory(dataDir)); !errors.Is(err, fs.ErrNotExist) {
+			return true, fmt.Errorf("%s already has a memory directory", dataDir)
+		}
+		if err := os.Rename(legacyMemories, memoriesDirectory(dataDir)); err != nil {
+			return true, err
+		}
+	}
+	return true, os.Rename(legacyDb, filepath.Join(dataDir, memoriesDbName))
+}
+
+func sameDirectory(a string, b string) (bool, error) {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bInfo, err := os.Stat(b)
+	if err != nil {
+		return false, err
+	}
+	return os.SameFile(aInfo, bInfo), nil
+}
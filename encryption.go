@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+const passphraseCheck string = "YAAP"
+const encryptingSuffix string = ".encrypting"
+
+// MemoryCipher encrypts memories at rest. A nil *MemoryCipher leaves data
+// untouched so the memory functions don't need to care if encryption is on.
+type MemoryCipher struct {
+	aead cipher.AEAD
+}
+
+func NewMemoryCipher(passphrase string, salt []byte) (*MemoryCipher, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryCipher{aead: aead}, nil
+}
+
+func (self *MemoryCipher) Seal(plain []byte) []byte {
+	if self == nil {
+		return plain
+	}
+	nonce := make([]byte, self.aead.NonceSize())
+	rand.Read(nonce)
+	return self.aead.Seal(nonce, nonce, plain, nil)
+}
+
+func (self *MemoryCipher) Open(data []byte) ([]byte, error) {
+	if self == nil {
+		return data, nil
+	}
+	if len(data) < self.aead.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	nonce, sealed := data[:self.aead.NonceSize()], data[self.aead.NonceSize():]
+	return self.aead.Open(nil, nonce, sealed, nil)
+}
+
+// Overhead is how much longer Seal makes data.
+func (self *MemoryCipher) Overhead() int {
+	if self == nil {
+		return 0
+	}
+	return self.aead.NonceSize() + self.aead.Overhead()
+}
+
+func (self *MemoryCipher) SealString(plain string) string {
+	if self == nil {
+		return plain
+	}
+	return base64.StdEncoding.EncodeToString(self.Seal([]byte(plain)))
+}
+
+func (self *MemoryCipher) OpenString(data string) (string, error) {
+	if self == nil || data == "" {
+		return data, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return "", err
+	}
+	plain, err := self.Open(decoded)
+	return string(plain), err
+}
+
+func getPassphrase() string {
+	if passphrase := os.Getenv("YAAP_PASSPHRASE"); passphrase != "" {
+		return passphrase
+	}
+	// Prompts go to stderr, stdout can be the output of the command.
+	fmt.Fprint(os.Stderr, "Memory passphrase: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		panic("failed to read passphrase: " + err.Error())
+	}
+	return string(passphrase)
+}
+
+// storeEncrypted reports whether the memory store has a passphrase.
+func storeEncrypted(db *sql.DB) bool {
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM encryption").Scan(&count)
+	return count > 0
+}
+
+// initEncryption returns the cipher for the memory store, or nil if the store
+// isn't encrypted and enable is false. Enabling encryption on a plaintext
+// store encrypts all existing memories.
+func initEncryption(db *sql.DB, dataDir string, enable bool) (*MemoryCipher, error) {
+	var salt, check []byte
+	err := db.QueryRow("SELECT salt, passphrase_check FROM encryption LIMIT 1").Scan(&salt, &check)
+	if errors.Is(err, sql.ErrNoRows) {
+		if err := finishEncryption(dataDir, false); err != nil {
+			return nil, err
+		}
+		if !enable {
+			return nil, nil
+		}
+		return enableEncryption(db, dataDir, getPassphrase())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	memoryCipher, err := NewMemoryCipher(getPassphrase(), salt)
+	if err != nil {
+		return nil, err
+	}
+	if plain, err := memoryCipher.Open(check); err != nil || string(plain) != passphraseCheck {
+		return nil, errors.New("wrong passphrase for the memory store")
+	}
+	if err := finishEncryption(dataDir, true); err != nil {
+		return nil, err
+	}
+	return memoryCipher, nil
+}
+
+func enableEncryption(db *sql.DB, dataDir string, passphrase string) (*MemoryCipher, error) {
+	if passphrase == "" {
+		return nil, errors.New("an empty passphrase can't be used to encrypt memories")
+	}
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	memoryCipher, err := NewMemoryCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, title, tags FROM memories")
+	if err != nil {
+		return nil, err
+	}
+	var memories []MemoryDto
+	for rows.Next() {
+		var memory MemoryDto
+		if err := rows.Scan(&memory.Id, &memory.Title, &memory.Tags); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		memories = append(memories, memory)
+	}
+	rows.Close()
+
+	// The encrypted files are written next to the plaintext ones and only
+	// replace them once the database says the store is encrypted, so a
+	// failure part way leaves a readable plaintext store.
+	var encrypted []MemoryDto
+	for _, memory := range memories {
+		content, err := os.ReadFile(memoryFilePath(dataDir, memory.Id))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err == nil {
+			err = os.WriteFile(encryptingFilePath(dataDir, memory.Id), memoryCipher.Seal(content), 0600)
+		}
+		if err != nil {
+			removeEncryptingFiles(dataDir)
+			return nil, err
+		}
+		encrypted = append(encrypted, memory)
+	}
+
+	if err := encryptDatabase(db, memoryCipher, salt, memories); err != nil {
+		removeEncryptingFiles(dataDir)
+		return nil, err
+	}
+	// A rename that fails from here on is finished by the next start.
+	for _, memory := range encrypted {
+		if err := os.Rename(encryptingFilePath(dataDir, memory.Id), memoryFilePath(dataDir, memory.Id)); err != nil {
+			return nil, err
+		}
+	}
+	return memoryCipher, nil
+}
+
+// encryptDatabase encrypts the titles and tags and marks the store as
+// encrypted in one transaction.
+func encryptDatabase(db *sql.DB, memoryCipher *MemoryCipher, salt []byte, memories []MemoryDto) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, memory := range memories {
+		_, err := tx.Exec(
+			"UPDATE memories SET title=?, tags=? WHERE id=?",
+			memoryCipher.SealString(memory.Title), memoryCipher.SealString(memory.Tags), memory.Id,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(
+		"INSERT INTO encryption (salt, passphrase_check) VALUES (?, ?)",
+		salt, memoryCipher.Seal([]byte(passphraseCheck)),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// encryptingFilePath is where the encrypted copy of a memory waits until the
+// store is marked as encrypted, the dot keeps it out of the memory listing.
+func encryptingFilePath(dataDir string, memoryId string) string {
+	return filepath.Join(memoriesDirectory(dataDir), "."+memoryId+encryptingSuffix)
+}
+
+// finishEncryption cleans up after enabling encryption was cut short. Once
+// the store is encrypted the waiting copies replace the plaintext files,
+// before that they are thrown away.
+func finishEncryption(dataDir string, encrypted bool) error {
+	if !encrypted {
+		return removeEncryptingFiles(dataDir)
+	}
+	paths, err := filepath.Glob(filepath.Join(memoriesDirectory(dataDir), ".*"+encryptingSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		memoryId := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "."), encryptingSuffix)
+		if err := os.Rename(path, memoryFilePath(dataDir, memoryId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeEncryptingFiles(dataDir string) error {
+	paths, err := filepath.Glob(filepath.Join(memoriesDirectory(dataDir), ".*"+encryptingSuffix))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
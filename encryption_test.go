@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemoryCipherRoundTrip(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	cipher, err := NewMemoryCipher("correct horse", salt)
+	if err != nil {
+		t.Fatalf("NewMemoryCipher returned error %v", err)
+	}
+	tests := [][]byte{
+		{},
+		[]byte("hello"),
+		[]byte("a longer memory with\nseveral lines and ünicode"),
+		bytes.Repeat([]byte{0}, 4096),
+	}
+	for _, plain := range tests {
+		sealed := cipher.Seal(plain)
+		if len(sealed) != len(plain)+cipher.Overhead() {
+			t.Errorf("Seal(%q) is %d bytes, want %d", plain, len(sealed), len(plain)+cipher.Overhead())
+		}
+		if len(plain) > 0 && bytes.Contains(sealed, plain) {
+			t.Errorf("Seal(%q) contains the plain text", plain)
+		}
+		got, err := cipher.Open(sealed)
+		if err != nil {
+			t.Errorf("Open(Seal(%q)) returned error %v", plain, err)
+			continue
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("Open(Seal(%q)) = %q", plain, got)
+		}
+
+		sealedString := cipher.SealString(string(plain))
+		gotString, err := cipher.OpenString(sealedString)
+		if err != nil || gotString != string(plain) {
+			t.Errorf("OpenString(SealString(%q)) = %q, %v", plain, gotString, err)
+		}
+	}
+}
+
+func TestMemoryCipherErrors(t *testing.T) {
+	salt := []byte("0123456789abcdef")
+	cipher, err := NewMemoryCipher("correct horse", salt)
+	if err != nil {
+		t.Fatalf("NewMemoryCipher returned error %v", err)
+	}
+	wrongPassphrase, err := NewMemoryCipher("wrong horse", salt)
+	if err != nil {
+		t.Fatalf("NewMemoryCipher returned error %v", err)
+	}
+	wrongSalt, err := NewMemoryCipher("correct horse", []byte("fedcba9876543210"))
+	if err != nil {
+		t.Fatalf("NewMemoryCipher returned error %v", err)
+	}
+	sealed := cipher.Seal([]byte("secret memory"))
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name   string
+		cipher *MemoryCipher
+		data   []byte
+	}{
+		{"wrong passphrase", wrongPassphrase, sealed},
+		{"wrong salt", wrongSalt, sealed},
+		{"tampered data", cipher, tampered},
+		{"too short", cipher, sealed[:4]},
+		{"plain text", cipher, []byte("secret memory that was never sealed")},
+	}
+	for _, test := range tests {
+		if got, err := test.cipher.Open(test.data); err == nil {
+			t.Errorf("%s: Open = %q, want an error", test.name, got)
+		}
+	}
+	if got, err := wrongPassphrase.OpenString(cipher.SealString("secret memory")); err == nil {
+		t.Errorf("wrong passphrase: OpenString = %q, want an error", got)
+	}
+}
+
+func TestNilMemoryCipher(t *testing.T) {
+	var cipher *MemoryCipher
+	plain := []byte("not encrypted")
+	if got := cipher.Seal(plain); !bytes.Equal(got, plain) {
+		t.Errorf("nil Seal(%q) = %q, want it unchanged", plain, got)
+	}
+	if got, err := cipher.Open(plain); err != nil || !bytes.Equal(got, plain) {
+		t.Errorf("nil Open(%q) = %q, %v, want it unchanged", plain, got, err)
+	}
+	if got := cipher.Overhead(); got != 0 {
+		t.Errorf("nil Overhead() = %d, want 0", got)
+	}
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"net/http"
-	"os"
 	"strings"
-	"time"
+	"sync"
+
+	"github.com/invopop/jsonschema"
 )
 
 func buildPrompt(state *State, prompt string, context string) string {
@@ -20,7 +22,7 @@ func buildPrompt(state *State, prompt string, context string) string {
 			%s
 		`, context, state.Memory.GetMemoryForModel(), prompt)
 	}
-	fileContent, err := os.ReadFile(state.FileName)
+	fileContent, err := readFile(state)
 	if err != nil {
 		state.Logger.Warn("Failed to read file", slog.String("fileName", state.FileName), slog.Any("err", err))
 		return fmt.Sprintf(`
@@ -33,7 +35,6 @@ func buildPrompt(state *State, prompt string, context string) string {
 			`, context, state.Memory.GetMemoryForModel(), prompt) // TODO: Return err
 	}
 
-
 	return fmt.Sprintf(`
 		[context]
 		%s
@@ -46,24 +47,32 @@ func buildPrompt(state *State, prompt string, context string) string {
 	`, context, string(fileContent), state.Memory.GetMemoryForModel(), prompt)
 
 }
+
+// forEachConcurrently runs work on every item, at most Settings.Concurrency
+// at a time, and returns the results in the order of the items.
+func forEachConcurrently[T any](state *State, items []string, work func(item string) T) []T {
+	results := make([]T, len(items))
+	limit := make(chan struct{}, max(state.Settings.Concurrency, 1))
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		limit <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-limit }()
+			results[i] = work(item)
+		}()
+	}
+	wg.Wait()
+	return results
+}
 func getLinks(state *State, client *http.Client, question string) []string {
 	state.Logger.Debug("Getting links")
-	month := time.Now().Month().String()
-	year := time.Now().Year()
 
 	queriesList := getQueriesFromLightLLM(
 		state,
 		buildPrompt(state, question, ""),
-		fmt.Sprintf(`You answer quickly and accurately.
-		Rules:
-		- Your job is to turn a question into google queries
-		- The current date is %s %d if the user asks about something happening now
-		- You reply with between 1 and 3 short google queries separated by a newline character
-		- If the question references a file look at [file]
-		- Each query is a sentence built of multiple words
-		- **NEVER** have a query with only one word
-		- Keep the queries short ( between 3 to 5 words )
-		`, month, year)).Queries
+		renderPrompt(state, LinkQueriesPrompt)).Queries
 
 	var queries strings.Builder
 
@@ -79,42 +88,26 @@ func getLinks(state *State, client *http.Client, question string) []string {
 	links := getLinksFromLightLLM(
 		state,
 		buildPrompt(state, question, queries.String()),
-		fmt.Sprintf(
-			`You answer quickly and accurately using the provided markdown web snippets.
-			Rules:
-			- Use the provided markdown web snippets and only the provided markdown web snippets as context
-			- If the question references a file look at [file]
-			- Respond with 1-3 links that the most relavant to the users question and closest to %s %d
-			- Please make sure that you cover all parts of the user's question with the links you provide
-			- Only return links separated by newline characters nothing else
-			`, month, year,
-		),
+		renderPrompt(state, LinkSelectionPrompt),
 	)
 
 	linkList := make(map[string]struct{})
-	for _, link := range links.Links {
+	results := forEachConcurrently(state, links.Links, func(link string) *LinksList {
 		trimmed := strings.TrimSpace(link)
 		if trimmed == "" {
-			continue
+			return &LinksList{}
 		}
-		result := getLinksFromLightLLM(
+		// fmt.Fprintf(&sb, "# Original link: %s\n# Summarized Page:\n%s\n\n", trimmed, result)
+		return getLinksFromLightLLM(
 			state,
 			buildPrompt(state, question, getRequest(client, link)),
-			fmt.Sprintf(
-				`You answer quickly and accurately using the provided markdown web snippets.
-			Rules:
-			- Use the provided markdown web snippets and only the provided markdown web snippets as context
-			- If the question references a file look at [file]
-			- Respond with 1-3 links that the most relavant to the users question and closest to %s %d
-			- Please make sure that you cover all parts of the user's question with the links you provide
-			- Only return links separated by newline characters nothing else
-			`, month, year,
-			),
+			renderPrompt(state, LinkSelectionPrompt),
 		)
+	})
+	for _, result := range results {
 		for _, l := range result.Links {
 			linkList[l] = struct{}{}
 		}
-		// fmt.Fprintf(&sb, "# Original link: %s\n# Summarized Page:\n%s\n\n", trimmed, result)
 	}
 	items := make([]string, 0, len(linkList))
 	for k := range linkList {
@@ -123,16 +116,18 @@ func getLinks(state *State, client *http.Client, question string) []string {
 	return items
 
 }
-func researchMode(state *State, question string) (string, []string) {
+func researchMode(state *State, question string) (*LLMResponse, []string) {
 	state.Logger.Debug("Triggering research mode")
 	client := &http.Client{}
 	links := getLinks(state, client, question)
 
 	var toParse strings.Builder
 	state.Logger.Debug("Parsing links")
-	for _, article := range links {
-		result := callLightLLM(
+	results := forEachConcurrently(state, links, func(article string) *LLMResponse {
+		// result := getRequest(client, item)
+		return callLightLLM(
 			state,
+			Summarization,
 			fmt.Sprintf(`
 			[web page]
 			%s
@@ -141,52 +136,36 @@ func researchMode(state *State, question string) (string, []string) {
 			[prompt]
 			Please get relavant information for the question from the web page 
 			`, getRequest(client, article), question),
-			`You get relavant to a question from a web page
-			Rules:
-			- Always return a summary of only information relavant to the user question
-			- Please make sure that you return the whole context for the question
-			- **NEVER** respond with anything that is not code
-			`,
+			renderPrompt(state, ResearchExtractPrompt),
 		)
-		// result := getRequest(client, item)
+	})
+	for _, result := range results {
 		fmt.Fprintf(&toParse, "%s", result.Response)
 	}
 	state.Logger.Debug("Preparing final response")
 	finalAnswer := callHeavyLLM(
 		state,
 		buildPrompt(state, question, toParse.String()),
-		`You answer quickly and accurately using the provided markdown web pages.
-		Rules:
-		- Please **always provide a link** to the web page that you got your information from.
-		- Please **always cite your sources**
-		- Use the provided links and fetched pages as context
-		- If you don't understand the context of the user's question look for it in the history section
-		- If the question references a file look at [file]
-		- If you see information not relavant to the question in the page please disregard it
-		- Only reply to the user's question
-		- Respond with information closest to %s %d
-		- Look for dates in provided pages and specify it in your response
-		- Please provide the exact answer for the user's question according to the markdown web pages provided, not suggestions to how the user can figure out the answer by themselves.
-		- If you don't find the answer in the provided pages please say so explicitly.
-		- You always respond in markdown
-		`,
+		renderPrompt(state, ResearchAnswerPrompt),
 	)
 
 	fmt.Printf("\nToken count: %d\n", finalAnswer.PromptEvalCount)
 
-	return finalAnswer.Response, links
+	return finalAnswer, links
 }
 
-func codeMode(state *State, question string) (string, []string) {
+func codeMode(state *State, question string) (*LLMResponse, []string) {
 	state.Logger.Debug("Triggering code mode")
 	client := &http.Client{}
 
 	links := getLinks(state, client, question)
 
 	var toParse strings.Builder
-	for _, link := range links {
-		result := callLightLLM(
+	results := forEachConcurrently(state, links, func(link string) *LLMResponse {
+		// result := getRequest(client, item)
+		return callLightLLM(
 			state,
+			Summarization,
 			fmt.Sprintf(`
 			[web page]
 			%s
@@ -195,51 +174,36 @@ func codeMode(state *State, question string) (string, []string) {
 			[prompt]
 			Please get relavant code example from this web page
 			`, getRequest(client, link), question),
-			`You get code examples from web pages
-			Rules:
-			- Always only return code examples
-			- Return code examples relavant to the question
-			- **NEVER** respond with anything that is not code
-			`,
+			renderPrompt(state, CodeExtractPrompt),
 		)
-		// result := getRequest(client, item)
+	})
+	for _, result := range results {
 		fmt.Fprintf(&toParse, "%s", result.Response)
 	}
 	finalAnswer := callHeavyLLM(
 		state,
 		buildPrompt(state, question, toParse.String()),
-		`You answer quickly and accurately using the provided code examples.
-		Rules:
-		- Please **always provide a link** to the web page that you got your information from.
-		- Please **always cite your sources**
-		- If you don't understand the context of the user's question look for it in the history section
-		- Use the provided code examples as context for your answer
-		- If the question references a file look at [file]
-		- If you see information or code not relavant to the question in the page please disregard it
-		- Only reply to the user's question
-		- Respond with information closest to %s %d
-		- Look for dates in provided pages and specify it in your response
-		- Please provide the exact example for the user's question according to the code examples provided, not suggestions to how the user can figure out the answer by themselves.
-		- If you don't find the answer in the provided examples please say so explicitly.
-		- You always respond in markdown
-		`,
+		renderPrompt(state, CodeAnswerPrompt),
 	)
 
 	fmt.Printf("\nToken count: %d\n", finalAnswer.PromptEvalCount)
 
-	return finalAnswer.Response, links
+	return finalAnswer, links
 }
-func lightCodeMode(state *State, question string) (string, []string) {
+func lightCodeMode(state *State, question string) (*LLMResponse, []string) {
 	state.Logger.Debug("Triggering light code mode")
 	client := &http.Client{}
 	links := getLinks(state, client, question)
 	var toParse strings.Builder
-	for _, link := range links {
-		result := getRequest(client, link)
+	pages := forEachConcurrently(state, links, func(link string) string {
+		return getRequest(client, link)
+	})
+	for _, result := range pages {
 		fmt.Fprintf(&toParse, "%s", result)
 	}
 	finalAnswer := callLightLLM(
 		state,
+		FinalAnswerStage,
 		fmt.Sprintf(`
 		[web pages]
 		%s
@@ -250,34 +214,74 @@ func lightCodeMode(state *State, question string) (string, []string) {
 		[prompt]
 		Please get relavant code example from these web pages
 		`, toParse.String(), state.Memory.GetMemoryForModel(), question),
-		`You get code examples from web pages
-		Rules:
-		- Always only return code examples
-		- Return code examples relavant to the question
-		- **NEVER** respond with anything that is not code
-		`,
+		renderPrompt(state, CodeExtractPrompt),
 	)
 
 	fmt.Printf("\nToken count: %d\n", finalAnswer.PromptEvalCount)
 
-	return finalAnswer.Response, links
+	return finalAnswer, links
+}
+func normalMode(state *State, question string) (*LLMResponse, []string) {
+	state.Logger.Debug("Triggering normal mode")
+	answer := callHeavyLLM(
+		state,
+		buildPrompt(state, question, ""),
+		renderPrompt(state, NormalAnswerPrompt),
+	)
+	return answer, nil
+}
+
+// autoRoutes maps the answers of the routing model to the mode that runs.
+var autoRoutes = map[string]OperatingMode{
+	"normal":   Normal,
+	"search":   Search,
+	"research": Research,
+	"code":     Code,
+}
+
+func routeQuestion(state *State, question string) OperatingMode {
+	answer := callLLM(
+		state,
+		getModelOptions(state, Routing, false),
+		state.Settings.LightTimeout,
+		buildPrompt(state, question, ""),
+		renderPrompt(state, AutoRoutePrompt),
+		jsonschema.Reflect(&RouteDecision{}),
+	)
+	decision := &RouteDecision{}
+	json.Unmarshal([]byte(answer.Response), decision)
+	mode, ok := autoRoutes[strings.ToLower(strings.TrimSpace(decision.Mode))]
+	if !ok {
+		state.Logger.Warn("Couldn't route question, falling back to normal mode", slog.String("decision", answer.Response))
+		return Normal
+	}
+	return mode
+}
+
+// autoMode lets the light model pick the mode for the question and runs it
+// as if it were the current mode.
+func autoMode(state *State, question string) (*LLMResponse, []string) {
+	state.Logger.Debug("Triggering auto mode")
+	mode := routeQuestion(state, question)
+	info, _ := getModeInfo(mode)
+	state.Logger.Info("Auto mode picked a mode", slog.String("mode", info.Name))
+	fmt.Printf("\nAuto picked %s mode\n", info.Name)
+	if info.Status != "" {
+		fmt.Println(info.Status)
+	}
+
+	state.RoutedMode = mode
+	state.OperatingMode = mode
+	defer func() { state.OperatingMode = Auto }()
+	return info.Run(state, question)
 }
-func lookupMode(state *State, question string) string {
+func lookupMode(state *State, question string) (*LLMResponse, []string) {
 	state.Logger.Debug("Triggering lookup mode")
-	month := time.Now().Month().String()
-	year := time.Now().Year()
 	client := &http.Client{}
 	lines := getQueriesFromLightLLM(
 		state,
 		buildPrompt(state, question, ""),
-		fmt.Sprintf(`You answer quickly and accurately.
-		Rules:
-		- Your job is to turn a question into google queries
-		- The current date is %s %d if the user asks about something happening now
-		- You reply with between 1 and 3 short google queries
-		- If the question references a file look at [file]
-		- Keep the queries short ( between 3 to 5 words )
-		`, month, year)).Queries
+		renderPrompt(state, SearchQueriesPrompt)).Queries
 
 	var sb strings.Builder
 
@@ -299,18 +303,8 @@ func lookupMode(state *State, question string) string {
 	finalAnswer := callHeavyLLM(
 		state,
 		buildPrompt(state, question, sb.String()),
-		fmt.Sprintf(`You answer quickly and accurately using the provided markdown web snippets.
-		Rules:
-		- Please **always provide a link** to the article that you got your information from.
-		- Please **always cite your sources**
-		- Respond with information closest to %s %d
-		- If the question references a file look at [file]
-		- Use the provided original queries and responses as context
-		- Please provide the exact answer for the user's question according to the markdown web snippets provided, not suggestions to how the user can figure out the answer by themselves.
-		- If you don't find the answer in the provided markdown web snippets please say so explicitly.
-		- You always respond in markdown
-		`, month, year),
+		renderPrompt(state, SearchAnswerPrompt),
 	)
 	fmt.Printf("\nToken Count: %d", finalAnswer.PromptEvalCount)
-	return finalAnswer.Response
+	return finalAnswer, nil
 }
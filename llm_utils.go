@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"strings"
@@ -13,8 +15,10 @@ import (
 )
 
 type LLMResponse struct {
+	Model           string `json:"model"`
 	Response        string `json:"response"`
 	PromptEvalCount int    `json:"prompt_eval_count"`
+	EvalCount       int    `json:"eval_count"`
 }
 type LinksList struct {
 	Links []string `json:"links"`
@@ -27,18 +31,158 @@ type Decision struct {
 	Decision bool `json:"decision"`
 }
 
-func ollamaGenerate(client *http.Client, baseURL, model, system string, prompt string, format *jsonschema.Schema, ctx context.Context) (*LLMResponse, error) {
+// ChatMessage is a message of Ollama's chat endpoint, tool results are sent
+// back as messages with the tool role.
+type ChatMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+type OllamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+type ToolDefinition struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+type ToolFunction struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Parameters  any    `json:"parameters"`
+}
+type ChatResponse struct {
+	Model           string      `json:"model"`
+	Message         ChatMessage `json:"message"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+	EvalCount       int         `json:"eval_count"`
+}
+type RouteDecision struct {
+	Mode string `json:"mode" jsonschema:"enum=normal,enum=search,enum=research,enum=code"`
+}
+
+// Stage is a step of a mode's pipeline that calls a model.
+type Stage int
+
+const (
+	QueryGeneration Stage = iota
+	LinkSelection
+	Summarization
+	FinalAnswerStage
+	Titling
+	Routing
+)
+
+func (s Stage) String() string {
+	switch s {
+	case QueryGeneration:
+		return "query_generation"
+	case LinkSelection:
+		return "link_selection"
+	case Summarization:
+		return "summarization"
+	case FinalAnswerStage:
+		return "final_answer"
+	case Titling:
+		return "title"
+	case Routing:
+		return "routing"
+	}
+
+	return fmt.Sprintf("unknown(%d)", int(s))
+}
+
+var stages = []Stage{QueryGeneration, LinkSelection, Summarization, FinalAnswerStage, Titling, Routing}
+
+func stageFromName(name string) (Stage, bool) {
+	for _, stage := range stages {
+		if stage.String() == name {
+			return stage, true
+		}
+	}
+	return QueryGeneration, false
+}
+
+// ModelOptions is the model and sampling parameters used for one call,
+// unset fields fall back to Ollama's defaults for the model.
+type ModelOptions struct {
+	Model       string   `yaml:"model"`
+	Temperature *float64 `yaml:"temperature"`
+	TopP        *float64 `yaml:"top_p"`
+	NumCtx      int      `yaml:"num_ctx"`
+	Seed        *int     `yaml:"seed"`
+	KeepAlive   string   `yaml:"keep_alive"`
+}
+
+// Apply overrides the options with the fields set in overrides.
+func (self ModelOptions) Apply(overrides ModelOptions) ModelOptions {
+	if overrides.Model != "" {
+		self.Model = overrides.Model
+	}
+	if overrides.Temperature != nil {
+		self.Temperature = overrides.Temperature
+	}
+	if overrides.TopP != nil {
+		self.TopP = overrides.TopP
+	}
+	if overrides.NumCtx > 0 {
+		self.NumCtx = overrides.NumCtx
+	}
+	if overrides.Seed != nil {
+		self.Seed = overrides.Seed
+	}
+	if overrides.KeepAlive != "" {
+		self.KeepAlive = overrides.KeepAlive
+	}
+	return self
+}
+
+// getModelOptions resolves the options of a stage in the current mode, the
+// light or heavy model is overridden by the profile's defaults for the stage
+// and then by the stage of the current mode.
+func getModelOptions(state *State, stage Stage, heavy bool) ModelOptions {
+	options := ModelOptions{Model: state.Settings.LightModel, Temperature: &state.Settings.LightTemperature}
+	if heavy {
+		options = ModelOptions{Model: state.Settings.HeavyModel, Temperature: &state.Settings.HeavyTemperature}
+	}
+	options = options.Apply(state.Settings.DefaultStages[stage])
+	return options.Apply(state.Settings.Stages[state.OperatingMode][stage])
+}
+
+func ollamaOptions(options ModelOptions) map[string]any {
+	modelOptions := map[string]any{}
+	if options.Temperature != nil {
+		modelOptions["temperature"] = *options.Temperature
+	}
+	if options.TopP != nil {
+		modelOptions["top_p"] = *options.TopP
+	}
+	if options.NumCtx > 0 {
+		modelOptions["num_ctx"] = options.NumCtx
+	}
+	if options.Seed != nil {
+		modelOptions["seed"] = *options.Seed
+	}
+	return modelOptions
+}
+
+func ollamaGenerate(client *http.Client, baseURL, system string, prompt string, options ModelOptions, format *jsonschema.Schema, ctx context.Context) (*LLMResponse, error) {
 	out := &LLMResponse{}
+	modelOptions := ollamaOptions(options)
 	reqBody := map[string]any{
-		"model":  model,
+		"model":  options.Model,
 		"prompt": prompt,
 		"system": system,
 		"stream": false,
 		// You can tune for speed:
-		"options": map[string]any{
-			"temperature": 0.2,
-		},
-		"format": format,
+		"options": modelOptions,
+		"format":  format,
+	}
+	if options.KeepAlive != "" {
+		reqBody["keep_alive"] = options.KeepAlive
 	}
 	b, _ := json.Marshal(reqBody)
 
@@ -63,57 +207,78 @@ func ollamaGenerate(client *http.Client, baseURL, model, system string, prompt s
 	return out, nil
 }
 
-func getQueriesFromLightLLM(state *State, prompt string, system string) *QueriesList {
-	client := &http.Client{}
-	schema := jsonschema.Reflect(&QueriesList{})
+func ollamaChat(client *http.Client, baseURL string, messages []ChatMessage, tools []ToolDefinition, options ModelOptions, ctx context.Context) (*ChatResponse, error) {
+	out := &ChatResponse{}
+	reqBody := map[string]any{
+		"model":    options.Model,
+		"messages": messages,
+		"stream":   false,
+		"options":  ollamaOptions(options),
+	}
+	if len(tools) > 0 {
+		reqBody["tools"] = tools
+	}
+	if options.KeepAlive != "" {
+		reqBody["keep_alive"] = options.KeepAlive
+	}
+	b, _ := json.Marshal(reqBody)
 
-	ctx, cancelLLM := context.WithTimeout(context.Background(), 1*time.Minute)
-	defer cancelLLM()
-	answer, err := ollamaGenerate(client, state.Settings.OllamaUrl, state.Settings.LightModel, system, prompt, schema, ctx)
+	req, err := http.NewRequestWithContext(ctx, "POST",
+		strings.TrimRight(baseURL, "/")+"/api/chat",
+		bytes.NewReader(b),
+	)
 	if err != nil {
-		state.Logger.Error("Failed to call LLM", slog.Any("err", err))
+		return out, err
 	}
-	queries := &QueriesList{}
-	json.Unmarshal([]byte(answer.Response), queries)
-
-	return queries
-}
-func getLinksFromLightLLM(state *State, prompt string, system string) *LinksList {
-	client := &http.Client{}
-	schema := jsonschema.Reflect(&LinksList{})
+	req.Header.Set("Content-Type", "application/json")
 
-	ctx, cancelLLM := context.WithTimeout(context.Background(), 1*time.Minute)
-	defer cancelLLM()
-	answer, err := ollamaGenerate(client, state.Settings.OllamaUrl, state.Settings.LightModel, system, prompt, schema, ctx)
+	resp, err := client.Do(req)
 	if err != nil {
-		state.Logger.Error("Failed to call LLM", slog.Any("err", err))
+		return out, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return out, fmt.Errorf("ollama replied %s: %s", resp.Status, strings.TrimSpace(string(body)))
 	}
-	linksList := &LinksList{}
-	json.Unmarshal([]byte(answer.Response), linksList)
 
-	return linksList
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return out, err
+	}
+	return out, nil
 }
-func callLightLLM(state *State, prompt string, system string) *LLMResponse {
+
+// callLLM calls a model with the given options and logs failures, the
+// answer is empty when the call fails.
+func callLLM(state *State, options ModelOptions, timeout time.Duration, prompt string, system string, format *jsonschema.Schema) *LLMResponse {
 	client := &http.Client{}
-	ctx, cancelLLM := context.WithTimeout(context.Background(), 1*time.Minute)
+	ctx, cancelLLM := context.WithTimeout(context.Background(), timeout)
 	defer cancelLLM()
 
-	answer, err := ollamaGenerate(client, state.Settings.OllamaUrl, state.Settings.LightModel, system, prompt, nil, ctx)
+	answer, err := ollamaGenerate(client, state.Settings.OllamaUrl, system, prompt, options, format, ctx)
 	if err != nil {
 		state.Logger.Error("Failed to call LLM", slog.Any("err", err))
 	}
 
 	return answer
 }
-func callHeavyLLM(state *State, prompt string, system string) *LLMResponse {
-	client := &http.Client{}
-	ctx, cancelLLM := context.WithTimeout(context.Background(), 5*time.Minute)
-	defer cancelLLM()
+func getQueriesFromLightLLM(state *State, prompt string, system string) *QueriesList {
+	answer := callLLM(state, getModelOptions(state, QueryGeneration, false), state.Settings.LightTimeout, prompt, system, jsonschema.Reflect(&QueriesList{}))
+	queries := &QueriesList{}
+	json.Unmarshal([]byte(answer.Response), queries)
 
-	answer, err := ollamaGenerate(client, state.Settings.OllamaUrl, state.Settings.HeavyModel, system, prompt, nil, ctx)
-	if err != nil {
-		state.Logger.Error("Failed to call LLM", slog.Any("err", err))
-	}
+	return queries
+}
+func getLinksFromLightLLM(state *State, prompt string, system string) *LinksList {
+	answer := callLLM(state, getModelOptions(state, LinkSelection, false), state.Settings.LightTimeout, prompt, system, jsonschema.Reflect(&LinksList{}))
+	linksList := &LinksList{}
+	json.Unmarshal([]byte(answer.Response), linksList)
 
-	return answer
+	return linksList
+}
+func callLightLLM(state *State, stage Stage, prompt string, system string) *LLMResponse {
+	return callLLM(state, getModelOptions(state, stage, false), state.Settings.LightTimeout, prompt, system, nil)
+}
+func callHeavyLLM(state *State, prompt string, system string) *LLMResponse {
+	return callWithTools(state, getModelOptions(state, FinalAnswerStage, true), state.Settings.HeavyTimeout, prompt, system)
 }
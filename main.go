@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"embed"
 	"flag"
 	"fmt"
@@ -9,17 +10,20 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gomarkdown/markdown"
 	"github.com/gomarkdown/markdown/html"
 	"github.com/gomarkdown/markdown/parser"
+	"github.com/microcosm-cc/bluemonday"
 
-	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -27,42 +31,70 @@ import (
 var templates embed.FS
 
 type Settings struct {
-	HeavyModel string
-	OllamaUrl  string
-	SearxNGUrl string
-	LightModel string
+	HeavyModel       string
+	OllamaUrl        string
+	SearxNGUrl       string
+	LightModel       string
+	DefaultMode      OperatingMode
+	LightTimeout     time.Duration
+	HeavyTimeout     time.Duration
+	LightTemperature float64
+	HeavyTemperature float64
+	Concurrency      int
+	PromptsDir       string
+	DefaultStages    map[Stage]ModelOptions
+	Stages           map[OperatingMode]map[Stage]ModelOptions
+	DataDir          string
+	Retention        RetentionPolicy
+	AgentMaxSteps    int
 }
 
-type OperatingMode int
+func memoryHandler(state *State, command string) string {
+	if command == "l" || strings.HasPrefix(command, "l ") {
+		return listMemories(state, strings.TrimSpace(command[1:]))
+	}
 
-const (
-	Research OperatingMode = iota
-	Normal
-	Search
-	Code
-	FastCode
-)
+	if command == "rename" || strings.HasPrefix(command, "rename ") {
+		return renameMemory(state, strings.TrimSpace(command[len("rename"):]))
+	}
 
-func (s OperatingMode) String() string {
-	switch s {
-	case Research:
-		return "RESEARCH"
-	case Normal:
-		return "NORMAL"
-	case Search:
-		return "SEARCH"
-	case Code:
-		return "CODE"
-	case FastCode:
-		return "FASTCODE"
-	}
-
-	return fmt.Sprintf("UNKNOWN", int(s))
-}
+	if strings.HasPrefix(command, "tag ") {
+		return tagMemory(state, command[len("tag "):])
+	}
 
-func memoryHandler(state *State, command string) string {
-	if command == "l" {
-		return listMemories(state.Database)
+	if strings.HasPrefix(command, "untag ") {
+		return untagMemory(state, command[len("untag "):])
+	}
+
+	if command == "pin" || command == "unpin" {
+		return pinMemory(state, command == "pin")
+	}
+
+	if command == "gc" {
+		// Collecting touches the memories of every user, only the CLI can do it.
+		if state.FileRoot != "" {
+			return "Memories can only be collected from the CLI"
+		}
+		return gcMemories(state)
+	}
+
+	if strings.HasPrefix(command, "fork") {
+		index, err := strconv.Atoi(strings.TrimSpace(command[len("fork"):]))
+		if err != nil {
+			return "Please provide the index of the interaction to fork from"
+		}
+		if err := forkMemory(state, index); err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("Forked memory into %s", state.Memory.Id)
+	}
+
+	if strings.HasPrefix(command, "share ") {
+		return shareMemoryCommand(state, command[len("share "):], true)
+	}
+
+	if strings.HasPrefix(command, "unshare ") {
+		return shareMemoryCommand(state, command[len("unshare "):], false)
 	}
 
 	if command[:1] == "u" {
@@ -95,7 +127,9 @@ func memoryHandler(state *State, command string) string {
 
 	if command[:1] == "d" {
 		memoryId := strings.TrimSpace(command[1:])
-		deleteMemory(state, memoryId)
+		if err := deleteMemory(state, memoryId); err != nil {
+			return err.Error()
+		}
 		return "Deleting memory"
 
 	}
@@ -107,65 +141,183 @@ func memoryHandler(state *State, command string) string {
 		Usage:
 		  /memory <Flag> <Flag Value>
 		Flags:
-		  l - list memories
+		  l [Tag] - list memories, only the ones tagged with <Tag> if given
 		  u <Memory Id> - Load a specific memory
 		  r - Resume last memory
 		  rf - Rusume last memory and don't save the old one
 		  n - create a new memory and save the old one
 		  nf - create a new memory and don't save the old one
+		  fork <Index> - create a new memory from the interactions up to <Index> (starting at 0)
+		  rename [Title] - rename the current memory, a title is generated if none is given
+		  tag <Tag> - tag the current memory
+		  untag <Tag> - remove a tag from the current memory
+		  pin - pin the current memory to the top of the list
+		  unpin - unpin the current memory
+		  share <User> - let another user read the current memory
+		  unshare <User> - stop sharing the current memory with a user
+		  gc - remove memories outside the retention policy and clean up broken memories, CLI only
 		`
 	}
 	return ""
 }
 func modeHandler(state *State, command string) string {
-	if command == "r" {
-		state.OperatingMode = Research
+	if mode, ok := modeFromFlag(command); ok {
+		state.OperatingMode = mode
 		return ""
 	}
-	if command == "s" {
-		state.OperatingMode = Search
+	if mode, ok := modeFromName(command); ok {
+		state.OperatingMode = mode
 		return ""
 	}
-	if command == "n" {
-		state.OperatingMode = Normal
-		return ""
+	if command == "h" {
+		return fmt.Sprintf(`Mode handler help
+
+		This is the way you can decide what modes your llm works in
+		Usage:
+		  /mode <Flag>
+		flags:
+%s		`, getModeFlags())
 	}
-	if command == "c" {
-		state.OperatingMode = Code
+	return ""
+}
+func interactionHandler(state *State, command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
 		return ""
 	}
-	if command == "fc" {
-		state.OperatingMode = FastCode
+	if fields[0] == "l" {
+		return listInteractions(state)
+	}
+	if fields[0] == "h" {
+		return `Interaction handler help
+
+		This is the way to fix individual questions and answers in the current memory
+		Usage:
+		  /interaction <Flag> <Flag Value>
+		flags:
+		  l - list the interactions of the current memory with their indices
+		  d <Index> - delete an interaction
+		  e <Index> [-m <Mode Flag>] <Question> - replace the question and regenerate its answer
+		  g <Index> [-m <Mode Flag>] - regenerate the answer of an interaction
+		  r [-m <Mode Flag>] - retry the last prompt
+		Mode flags are the same as /mode (r, s, n, c, fc), the mode and file the interaction was answered with are used if none is given
+		`
+	}
+
+	var index int
+	args := fields[1:]
+	if fields[0] == "r" {
+		index = len(state.Memory.Interactions) - 1
+	} else {
+		if len(args) == 0 {
+			return "Please provide the index of the interaction"
+		}
+		var err error
+		index, err = strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Sprintf("Bad interaction index %s", args[0])
+		}
+		args = args[1:]
+	}
+	if index < 0 || index >= len(state.Memory.Interactions) {
+		return fmt.Sprintf("No interaction with index %d", index)
+	}
+
+	interaction := state.Memory.Interactions[index]
+	mode, modeKnown := interaction.GetMode()
+	if len(args) >= 2 && args[0] == "-m" {
+		parsedMode, ok := modeFromFlag(args[1])
+		if !ok {
+			return fmt.Sprintf("Unknown mode flag %s", args[1])
+		}
+		mode, modeKnown = parsedMode, true
+		args = args[2:]
+	}
+
+	var question string
+	switch fields[0] {
+	case "d":
+		deleteInteraction(state, index)
+		return fmt.Sprintf("Deleted interaction %d", index)
+	case "e":
+		if len(args) == 0 {
+			return "Please provide the new question"
+		}
+		question = strings.Join(args, " ")
+	case "g", "r":
+		question = interaction.Question
+	default:
 		return ""
 	}
+	if !modeKnown {
+		return fmt.Sprintf("The mode %s of interaction %d doesn't exist anymore, pick one with -m", interaction.GetModeName(), index)
+	}
+	printed, err := regenerateInteraction(state, index, question, mode)
+	if err != nil {
+		return err.Error()
+	}
+	return printed
+}
+func profileHandler(state *State, command string) string {
+	if command == "l" {
+		return listProfiles(state)
+	}
+	if command == "c" {
+		return state.Profile
+	}
 	if command == "h" {
-		return `Mode handler help
+		return `Profile handler help
 
-		This is the way you can decide what modes your llm works in
+		This is the way to switch between the profiles of your config file
 		Usage:
-		  /mode <Flag>
+		  /profile <Flag>
 		flags:
-		  r - research mode (use if you want to have the model deep dive)
-		  s - search mode (use if you want the model to quickly search the web for current information)
-		  n - normal mode (use if you want the model to reply by itself)
-		  c - code mode (Use for accurate code examples with explanations)
-		  fc - fast code mode (Use for quick code prototyping)
+		  l - list profiles
+		  c - print the current profile
+		  <Profile Name> - switch to a profile
 		`
 	}
+	if command == "" {
+		return ""
+	}
+	return switchProfile(state, command)
+}
+func promptHandler(state *State, command string) string {
+	if command == "l" {
+		return listPrompts(state)
+	}
+	if strings.HasPrefix(command, "show ") {
+		return showModePrompts(state, strings.TrimSpace(command[len("show "):]))
+	}
+	if command == "h" {
+		return fmt.Sprintf(`Prompt handler help
+
+		This is the way to look at the system prompts your llm gets
+		Prompts can be overridden by putting a text/template file with the same name in %s
+		Usage:
+		  /prompt <Flag>
+		flags:
+		  l - list prompts and where they are loaded from
+		  show <Mode> - show the prompts a mode uses (e.g. /prompt show research or /prompt show r)
+		`, state.Settings.PromptsDir)
+	}
 	return ""
 }
 func fileHandler(state *State, command string) string {
 	if command[0] == 'o' {
-		fileName := strings.TrimSpace(command[1:])
+		fileName, err := resolveFile(state, strings.TrimSpace(command[1:]))
+		if err != nil {
+			return err.Error()
+		}
 		state.FileName = fileName
-		return fmt.Sprintf("Reading file %s\n", fileName)
+		return fmt.Sprintf("Reading file %s\n", displayFileName(fileName))
 	}
 	if command == "d" {
 		state.FileName = ""
 		return fmt.Sprintln("Discarding file")
 	}
 	if command == "c" {
-		return fmt.Sprintln(state.FileName)
+		return fmt.Sprintln(displayFileName(state.FileName))
 	}
 	if command == "h" {
 		return `File handler help
@@ -174,13 +326,30 @@ func fileHandler(state *State, command string) string {
 		Usage:
 		  /file <Flag>
 		flags:
-		  o <File Name> - File to have the LLM answer by
+		  o <File Name> - File to have the LLM answer by, only uploaded files in the web server
 		  d - Discard file you're using
 		  c - Print current file you're working on
 		`
 	}
 	return ""
 }
+func toolsHandler(state *State, command string) string {
+	if command == "" || command == "l" {
+		return listTools(state)
+	}
+	if command == "h" {
+		return `Tools handler help
+
+		This is the way to see the tools your llm can call
+		MCP servers are added in the mcp_servers section of the config file
+		Usage:
+		  /tools <Flag>
+		flags:
+		  l - list the tools (same as /tools)
+		`
+	}
+	return ""
+}
 func commandHandler(state *State, command string) string {
 	parsedCommand := strings.Split(command, " ")
 	commandName := parsedCommand[0]
@@ -193,6 +362,14 @@ func commandHandler(state *State, command string) string {
 		return memoryHandler(state, strings.Join(parsedCommand[1:], " "))
 	case "file":
 		return fileHandler(state, strings.Join(parsedCommand[1:], " "))
+	case "interaction":
+		return interactionHandler(state, strings.Join(parsedCommand[1:], " "))
+	case "profile":
+		return profileHandler(state, strings.Join(parsedCommand[1:], " "))
+	case "prompt":
+		return promptHandler(state, strings.Join(parsedCommand[1:], " "))
+	case "tools":
+		return toolsHandler(state, strings.Join(parsedCommand[1:], " "))
 	case "help":
 		return `YAAP - Yet Another Ai Program
 
@@ -200,6 +377,10 @@ func commandHandler(state *State, command string) string {
 		  /mode: change the execution mode (/mode h) for help
 		  /memory: memory commands (/memory h) for help
 		  /file: file commands (/file h) for help
+		  /interaction: edit, delete and regenerate answers (/interaction h) for help
+		  /profile: switch between config profiles (/profile h) for help
+		  /prompt: look at the system prompts (/prompt h) for help
+		  /tools: list the tools the llm can call (/tools h) for help
 		  /current: look at the name of the current loaded memory
 		  /exit: exit the program
 		`
@@ -209,36 +390,49 @@ func commandHandler(state *State, command string) string {
 }
 
 func executePrompt(state *State, prompt string) FinalAnswer {
-	var finalAnswer string
+	var answer *LLMResponse
 	var sources []string
-	switch state.OperatingMode {
-	case Research:
-		finalAnswer, sources = researchMode(state, prompt)
-	case Search:
-		finalAnswer = lookupMode(state, prompt)
-	case Normal:
-		answer := callHeavyLLM(
-			state,
-			buildPrompt(state, prompt, ""),
-			`You answer quickly and accurately using your own abilities.
-				Rules:
-				- If you don't know the answer always say you don't know
-				- You always respond in markdown
-			`,
-		)
-		finalAnswer = answer.Response
-	case Code:
-		finalAnswer, sources = codeMode(state, prompt)
-	case FastCode:
-		finalAnswer, sources = lightCodeMode(state, prompt)
-
-	}
-	return FinalAnswer{finalAnswer, sources}
+	start := time.Now()
+	state.ToolCalls = nil
+	// Only auto mode routes, every other mode answers as itself.
+	state.RoutedMode = state.OperatingMode
+	if info, ok := getModeInfo(state.OperatingMode); ok {
+		answer, sources = info.Run(state, prompt)
+	} else {
+		answer = &LLMResponse{}
+	}
+	return FinalAnswer{
+		FinalAnswer:     answer.Response,
+		Sources:         sources,
+		Mode:            state.OperatingMode,
+		RoutedMode:      state.RoutedMode,
+		ToolCalls:       state.ToolCalls,
+		Model:           answer.Model,
+		PromptEvalCount: answer.PromptEvalCount,
+		EvalCount:       answer.EvalCount,
+		Latency:         time.Since(start),
+	}
+}
+
+// answerWithMode answers a question with a mode and the history of memory on
+// a copy of the state, the current mode and memory are left alone and nothing
+// is remembered.
+func answerWithMode(state *State, mode OperatingMode, memory Memory, question string) FinalAnswer {
+	scratch := *state
+	scratch.OperatingMode, scratch.Memory, scratch.Remember = mode, memory, false
+	return executePrompt(&scratch, question)
 }
 
 type FinalAnswer struct {
-	FinalAnswer string
-	Sources     []string
+	FinalAnswer     string
+	Sources         []string
+	Mode            OperatingMode
+	RoutedMode      OperatingMode
+	ToolCalls       []ToolCall
+	Model           string
+	PromptEvalCount int
+	EvalCount       int
+	Latency         time.Duration
 }
 
 func elapsedTime(resultChan chan FinalAnswer, ticker *time.Ticker, start time.Time) FinalAnswer {
@@ -293,19 +487,13 @@ func getPrompt(state *State) string {
 }
 
 func respondToPrompt(state *State, prompt string) string {
-	extensions := parser.CommonExtensions
-	renderer := html.NewRenderer(html.RendererOptions{})
 	if prompt[0] == '/' {
-		return string(adaptForPrettify(markdown.ToHTML([]byte(commandHandler(state, prompt[1:])), parser.NewWithExtensions(extensions), renderer)))
+		return toHTML(commandHandler(state, prompt[1:]))
 	}
 
 	answer := executePrompt(state, prompt)
 	if state.Remember {
-		if len(state.Memory.Interactions) == 0 {
-			state.Memory.Title = prompt
-			state.Memory.Id = uuid.New().String()
-		}
-		state.Memory.Interactions = append(state.Memory.Interactions, ChatInteraction{Question: prompt, Answer: answer.FinalAnswer, Links: answer.Sources})
+		addInteraction(state, prompt, answer)
 	}
 
 	return toHTML(answer.FinalAnswer)
@@ -325,23 +513,15 @@ func cliHandler(state *State) {
 		if prompt[0] == '/' {
 			if prompt[1:] == "exit" {
 				saveMemory(state)
+				closeMCPConnections(state)
 				os.Exit(0)
 			}
 			fmt.Println(commandHandler(state, prompt[1:]))
 			continue
 		}
 
-		switch state.OperatingMode {
-		case Research:
-			fmt.Println("Researching!")
-		case Search:
-			fmt.Println("Looking it up!")
-		case Normal:
-			fmt.Println("Answering from memory!")
-		case Code:
-			fmt.Println("Coding!")
-		case FastCode:
-			fmt.Println("Fast Coding!")
+		if info, ok := getModeInfo(state.OperatingMode); ok && info.Status != "" {
+			fmt.Println(info.Status)
 		}
 		start := time.Now()
 		go func() {
@@ -349,11 +529,7 @@ func cliHandler(state *State) {
 		}()
 		answer := elapsedTime(resultChan, ticker, start)
 		if state.Remember {
-			if len(state.Memory.Interactions) == 0 {
-				state.Memory.Title = prompt
-				state.Memory.Id = uuid.New().String()
-			}
-			state.Memory.Interactions = append(state.Memory.Interactions, ChatInteraction{Question: prompt, Answer: answer.FinalAnswer, Links: answer.Sources})
+			addInteraction(state, prompt, answer)
 		}
 
 		out, err := state.Renderer.Render(answer.FinalAnswer)
@@ -376,58 +552,204 @@ func adaptForPrettify(html []byte) []byte {
 		[]byte(`<pre class="prettyprint lang-$1"><code>`),
 	)
 }
+
+// htmlPolicy cleans rendered markdown, the renderer doesn't escape the
+// language of code blocks.
+var htmlPolicy = func() *bluemonday.Policy {
+	policy := bluemonday.UGCPolicy()
+	policy.AllowAttrs("class").Matching(regexp.MustCompile(`^language-[\w+#.-]+$`)).OnElements("code")
+	return policy
+}()
+
+// toHTML renders markdown for the web UI. Answers quote web pages and shared
+// memories, so raw HTML in them is dropped and links only go to safe
+// protocols.
 func toHTML(output string) string {
 	extensions := parser.CommonExtensions
-	renderer := html.NewRenderer(html.RendererOptions{})
+	renderer := html.NewRenderer(html.RendererOptions{Flags: html.SkipHTML | html.Safelink})
 
-	return string(adaptForPrettify(markdown.ToHTML([]byte(output), parser.NewWithExtensions(extensions), renderer)))
+	return string(adaptForPrettify(htmlPolicy.SanitizeBytes(markdown.ToHTML([]byte(output), parser.NewWithExtensions(extensions), renderer))))
 
 }
-func webHandler(state *State) {
+
+// homeData is the data of the home page, notice is shown after the thread when
+// it isn't nil.
+func homeData(c *gin.Context, notice *WebNotice) gin.H {
+	session := getSession(c)
+	return gin.H{
+		"thread":      getWebThread(session.State),
+		"notice":      notice,
+		"mode":        session.State.OperatingMode.String(),
+		"currentMode": session.State.OperatingMode,
+		"modes":       modeRegistry,
+		"csrfToken":   session.CSRFToken,
+		"loggedIn":    session.LoggedIn,
+		"user":        session.State.User,
+		"memoryId":    session.State.Memory.Id,
+	}
+}
+
+// WebOptions configures the web server.
+type WebOptions struct {
+	// Listen is the address and port to listen on.
+	Listen string
+	// SessionTimeout is how long a session can be idle before its memory is
+	// saved and it ends, 0 keeps sessions until the server stops.
+	SessionTimeout time.Duration
+	// Token is a shared token that logs in without a user account.
+	Token string
+	// TLSCert and TLSKey serve HTTPS, SelfSigned generates them instead.
+	TLSCert    string
+	TLSKey     string
+	SelfSigned bool
+	// TrustedProxies are the reverse proxies whose forwarded headers are
+	// believed.
+	TrustedProxies []string
+	// BasePath is the path the web server is served under, e.g. /yaap.
+	BasePath string
+}
+
+func webHandler(state *State, options WebOptions) {
+	auth := &Auth{Database: state.Database, Token: options.Token, Logger: state.Logger}
+	if !auth.Enabled() && !isLoopback(options.Listen) {
+		fmt.Printf("Refusing to listen on %s without a login, add a user with --add-user, set YAAP_WEB_TOKEN or listen on 127.0.0.1\n", options.Listen)
+		os.Exit(1)
+	}
+	if (options.TLSCert == "") != (options.TLSKey == "") || (options.SelfSigned && options.TLSCert != "") {
+		fmt.Println("Use either both --tls-cert and --tls-key or --tls-self-signed")
+		os.Exit(1)
+	}
+	if options.SelfSigned {
+		var err error
+		options.TLSCert, options.TLSKey, err = selfSignedCertificate(state.Settings.DataDir)
+		if err != nil {
+			fmt.Println("Failed to generate a self-signed certificate:", err)
+			os.Exit(1)
+		}
+	}
+	if err := removeStaleUploads(state.Settings.DataDir); err != nil {
+		state.Logger.Warn("Failed to remove old uploads", slog.Any("err", err))
+	}
 	r := gin.Default()
+	r.MaxMultipartMemory = maxAttachmentSize
+	if err := r.SetTrustedProxies(options.TrustedProxies); err != nil {
+		fmt.Println("Bad trusted proxies:", err)
+		os.Exit(1)
+	}
 
 	tmpl := template.Must(
-		template.ParseFS(templates, "templates/*.html"),
+		template.New("").Funcs(template.FuncMap{
+			"path": func(path string) string { return options.BasePath + path },
+		}).ParseFS(templates, "templates/*.html"),
 	)
 	r.SetHTMLTemplate(tmpl)
 
-	r.GET("/", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "home.html", gin.H{
-			"answer": "Ask me anything",
-			"mode":   state.OperatingMode.String(),
-		})
+	root := r.Group(options.BasePath, func(c *gin.Context) {
+		c.Set(basePathContextKey, options.BasePath)
+	})
+	// The OpenAI routes don't keep anything between requests, so they work on
+	// copies of the base state. Everything else belongs to a session.
+	registerOpenAIRoutes(root.Group("/", auth.RequireAuthorization()), state)
+	sessions := NewSessionManager(state, options.SessionTimeout)
+	registerLoginRoutes(root.Group("/", sessions.Middleware()), auth, sessions)
+	web := root.Group("/", sessions.Middleware(), auth.Middleware())
+
+	web.GET("/", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "home.html", homeData(c, nil))
 	})
-	r.GET("/get-full-memory", func(c *gin.Context) {
+	web.GET("/thread", func(c *gin.Context) {
+		c.HTML(http.StatusOK, "thread", getWebThread(sessionState(c)))
+	})
+	web.GET("/get-full-memory", func(c *gin.Context) {
+		state := sessionState(c)
 		c.String(http.StatusOK, "%s", template.HTML(toHTML(state.Memory.GetPrintedMemory(state.Renderer))))
 	})
-	r.POST("/change-mode", func(c *gin.Context) {
+	web.POST("/change-mode", func(c *gin.Context) {
+		state := sessionState(c)
 		mode, err := strconv.Atoi(c.PostForm("mode"))
-		if err != nil {
+		if _, ok := getModeInfo(OperatingMode(mode)); err != nil || !ok {
 			c.String(http.StatusBadRequest, "Bad mode supplied")
+			return
 		}
 		state.OperatingMode = OperatingMode(mode)
 
 		c.String(http.StatusOK, state.OperatingMode.String())
 	})
 
-	r.POST("/", func(c *gin.Context) {
-		html := respondToPrompt(state, c.PostForm("value"))
-		if html == "" {
-			c.HTML(http.StatusOK, "home.html", gin.H{
-				"answer": template.HTML(toHTML(state.Memory.Interactions[len(state.Memory.Interactions)-1].Answer)),
-				"mode":   state.OperatingMode.String(),
-			})
+	// The page posts prompts to /message and adds the answer to the thread,
+	// posting to / is left for browsers without JavaScript.
+	web.POST("/", func(c *gin.Context) {
+		state := sessionState(c)
+		prompt := strings.TrimSpace(c.PostForm("value"))
+		if prompt == "" {
+			c.Redirect(http.StatusSeeOther, webPath(c, "/"))
+			return
+		}
+		html := respondToPrompt(state, prompt)
+		if prompt[0] != '/' && state.Remember {
+			c.HTML(http.StatusOK, "home.html", homeData(c, nil))
 			return
 		}
 
-		c.HTML(http.StatusOK, "home.html", gin.H{
-			"answer": template.HTML(html),
-			"mode":   state.OperatingMode.String(),
-		})
+		c.HTML(http.StatusOK, "home.html", homeData(c, &WebNotice{Question: prompt, Answer: template.HTML(html)}))
 	})
+	web.POST("/message", func(c *gin.Context) {
+		state := sessionState(c)
+		prompt := strings.TrimSpace(c.PostForm("value"))
+		if prompt == "" {
+			c.String(http.StatusBadRequest, "Empty prompt")
+			return
+		}
+		if prompt[0] == '/' {
+			memoryId, interactions := state.Memory.Id, len(state.Memory.Interactions)
+			html := respondToPrompt(state, prompt)
+			// Commands can load another memory or change this one, the page
+			// reloads the whole thread then.
+			if state.Memory.Id != memoryId || len(state.Memory.Interactions) != interactions {
+				c.Header("X-YAAP-Memory-Changed", "1")
+			}
+			c.HTML(http.StatusOK, "notice", WebNotice{Question: prompt, Answer: template.HTML(html)})
+			return
+		}
 
-	r.Run("0.0.0.0:12345")
+		answer := executePrompt(state, prompt)
+		interaction := newChatInteraction(state, prompt, answer)
+		if state.Remember {
+			addInteraction(state, prompt, answer)
+			interaction = state.Memory.Interactions[len(state.Memory.Interactions)-1]
+		}
+		c.Header("X-YAAP-Memory", state.Memory.Id)
+		c.HTML(http.StatusOK, "interaction", newWebInteraction(interaction, state.Remember))
+	})
 
+	registerAPIRoutes(web)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go sessions.ExpireIdle(ctx.Done())
+
+	server := &http.Server{Addr: options.Listen, Handler: r}
+	go func() {
+		var err error
+		if options.TLSCert != "" {
+			err = server.ListenAndServeTLS(options.TLSCert, options.TLSKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			state.Logger.Error("Web server stopped", slog.Any("err", err))
+			fmt.Println("Web server stopped:", err)
+			stop()
+		}
+	}()
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		state.Logger.Warn("Failed to stop the web server cleanly", slog.Any("err", err))
+	}
+	sessions.Close()
 }
 
 func main() {
@@ -456,6 +778,11 @@ func main() {
 		false,
 		"Should list memories",
 	)
+	memoryTag := flag.String(
+		"tag",
+		"",
+		"Only list memories with this tag (used with --list-memories)",
+	)
 	memoryToDelete := flag.String(
 		"delete-memory",
 		"",
@@ -476,27 +803,252 @@ func main() {
 		false,
 		"EXPERIMENTAL!! Start webserver",
 	)
-	db := initDb()
-	defer db.Close()
+	memoryMaxAge := flag.Duration(
+		"memory-max-age",
+		0,
+		"Memories not updated for longer than this are removed by --gc-memories, e.g. 720h (0 keeps them forever)",
+	)
+	memoryMaxCount := flag.Int(
+		"memory-max-count",
+		0,
+		"Only the newest memories up to this count are kept by --gc-memories (0 keeps all of them)",
+	)
+	keepPinned := flag.Bool(
+		"keep-pinned",
+		true,
+		"Never remove pinned memories when collecting memories",
+	)
+	shouldGcMemories := flag.Bool(
+		"gc-memories",
+		false,
+		"Remove memories outside the retention policy and clean up broken memories",
+	)
+	encrypt := flag.Bool(
+		"encrypt",
+		false,
+		"Encrypt the memory store with a passphrase taken from YAAP_PASSPHRASE or prompted for",
+	)
+	dataDirFlag := flag.String(
+		"data-dir",
+		getenv("YAAP_DATA_DIR", ""),
+		"Directory to store memories and logs in (defaults to $XDG_DATA_HOME/yaap, or the closest .yaap directory of a project)",
+	)
+	project := flag.Bool(
+		"project",
+		false,
+		"Keep memories in a .yaap directory inside the current directory instead of the shared data directory",
+	)
+	configPath := flag.String(
+		"config",
+		getenv("YAAP_CONFIG", defaultConfigPath()),
+		"Path to the config file with the profiles",
+	)
+	profileName := flag.String(
+		"profile",
+		getenv("YAAP_PROFILE", ""),
+		"Name of the config profile to use (defaults to default_profile of the config file)",
+	)
+	serveMCPFlag := flag.Bool(
+		"mcp",
+		false,
+		"Serve the research, search and code modes and the memories as MCP tools over stdio",
+	)
+	sessionTimeout := flag.Duration(
+		"session-timeout",
+		30*time.Minute,
+		"How long a web server session can be idle before its memory is saved and it ends (0 keeps sessions until the server stops)",
+	)
+	listen := flag.String(
+		"listen",
+		getenv("YAAP_LISTEN", "127.0.0.1:12345"),
+		"Address and port the web server listens on, listening outside of localhost needs a user or a token",
+	)
+	webToken := flag.String(
+		"web-token",
+		getenv("YAAP_WEB_TOKEN", ""),
+		"Shared token that logs in to the web server without a user account",
+	)
+	tlsCert := flag.String(
+		"tls-cert",
+		getenv("YAAP_TLS_CERT", ""),
+		"Certificate file to serve the web server over HTTPS with (needs --tls-key)",
+	)
+	tlsKey := flag.String(
+		"tls-key",
+		getenv("YAAP_TLS_KEY", ""),
+		"Key file of --tls-cert",
+	)
+	tlsSelfSigned := flag.Bool(
+		"tls-self-signed",
+		false,
+		"Serve the web server over HTTPS with a self-signed certificate kept in the data directory, for use on the LAN",
+	)
+	trustedProxies := flag.String(
+		"trusted-proxies",
+		getenv("YAAP_TRUSTED_PROXIES", ""),
+		"Comma separated addresses or networks of reverse proxies whose X-Forwarded-For headers are trusted",
+	)
+	basePath := flag.String(
+		"base-path",
+		getenv("YAAP_BASE_PATH", ""),
+		"Path the web server is served under behind a reverse proxy, e.g. /yaap",
+	)
+	userToAdd := flag.String(
+		"add-user",
+		"",
+		"Add a web server user or change their password, the password is taken from YAAP_PASSWORD or prompted for",
+	)
+	user := flag.String(
+		"user",
+		getenv("YAAP_USER", ""),
+		"Use the memories of this web server user instead of the local ones",
+	)
+	userToDelete := flag.String(
+		"delete-user",
+		"",
+		"Delete a web server user",
+	)
+	agentMaxSteps := flag.Int(
+		"agent-max-steps",
+		8,
+		"How many rounds of tool calls agent mode can make before it has to answer",
+	)
 	flag.Parse()
-	settings := Settings{
-		HeavyModel: *heavyModel,
-		LightModel: *lightModel,
-		OllamaUrl:  *ollamaUrl,
-		SearxNGUrl: *searxUrl,
+	if *agentMaxSteps < 1 {
+		fmt.Println("--agent-max-steps has to be at least 1")
+		os.Exit(1)
 	}
-	if *shouldListMemories {
-		fmt.Println(listMemories(db))
-		return
+	explicitFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+	isSet := func(flagName string, envName string) bool {
+		return explicitFlags[flagName] || os.Getenv(envName) != ""
+	}
+	overrides := Profile{}
+	if isSet("heavy-model", "HEAVY_MODEL") {
+		overrides.HeavyModel = *heavyModel
+	}
+	if isSet("light-model", "LIGHT_MODEL") {
+		overrides.LightModel = *lightModel
+	}
+	if isSet("ollama-url", "OLLAMA_URL") {
+		overrides.OllamaUrl = *ollamaUrl
+	}
+	if isSet("searx-url", "SEARXNG_URL") {
+		overrides.SearxNGUrl = *searxUrl
+	}
+	if explicitFlags["agent-max-steps"] {
+		overrides.AgentMaxSteps = *agentMaxSteps
+	}
+
+	dataDir, err := resolveDataDir(*dataDirFlag, *project)
+	if err != nil {
+		panic("failed to create data directory: " + err.Error())
+	}
+	if found, err := migrateLegacyStore(dataDir); err != nil {
+		// stderr keeps stdout clean for --mcp.
+		fmt.Fprintf(os.Stderr, "Found memories of an older version of YAAP in the working directory but couldn't move them to %s: %s\n", dataDir, err)
+		fmt.Fprintln(os.Stderr, "Use them with --data-dir . or move .memories.db and .memories yourself")
+	} else if found {
+		fmt.Fprintf(os.Stderr, "Moved the memories of an older version of YAAP from the working directory to %s\n", dataDir)
+	}
+	db := initDb(dataDir)
+	defer db.Close()
+	defaultMode := Search
+	if *webServer {
+		defaultMode = Normal
+	}
+	baseSettings := Settings{
+		HeavyModel:       *heavyModel,
+		LightModel:       *lightModel,
+		OllamaUrl:        *ollamaUrl,
+		SearxNGUrl:       *searxUrl,
+		DefaultMode:      defaultMode,
+		LightTimeout:     1 * time.Minute,
+		HeavyTimeout:     5 * time.Minute,
+		LightTemperature: 0.2,
+		HeavyTemperature: 0.2,
+		Concurrency:      1,
+		AgentMaxSteps:    *agentMaxSteps,
+		PromptsDir:       filepath.Join(filepath.Dir(*configPath), "prompts"),
+		DataDir:          dataDir,
+		Retention: RetentionPolicy{
+			MaxAge:     *memoryMaxAge,
+			MaxCount:   *memoryMaxCount,
+			KeepPinned: *keepPinned,
+		},
 	}
-	logFile, err := os.OpenFile(".YAAP.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	config, err := loadConfig(*configPath, baseSettings, overrides)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := registerCustomModes(config, baseSettings.PromptsDir); err != nil {
+		fmt.Println("Failed to load custom modes:", err)
+		os.Exit(1)
+	}
+	if *profileName == "" {
+		*profileName = config.DefaultProfile
+	}
+	settings, err := config.Settings(*profileName)
+	if err != nil {
+		fmt.Println("Failed to load settings:", err)
+		os.Exit(1)
+	}
+	// stdin and stdout are the MCP connection, so the passphrase can't be
+	// asked for.
+	if *serveMCPFlag && os.Getenv("YAAP_PASSPHRASE") == "" && (*encrypt || storeEncrypted(db)) {
+		fmt.Fprintln(os.Stderr, "The memory store is encrypted, set YAAP_PASSPHRASE to use it with --mcp")
+		os.Exit(1)
+	}
+	memoryCipher, err := initEncryption(db, dataDir, *encrypt)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to unlock the memory store:", err)
+		os.Exit(1)
+	}
+	logFile, err := os.OpenFile(filepath.Join(dataDir, ".YAAP.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
 	if err != nil {
 		panic("failed to open log file: " + err.Error())
 	}
-	state := NewState(settings, db, logFile)
+	state := NewState(settings, db, memoryCipher, logFile)
+	state.Config = config
+	state.Profile = *profileName
+	if *user != "" && !userExists(db, *user) {
+		fmt.Printf("There is no user %s, add them with --add-user\n", *user)
+		os.Exit(1)
+	}
+	// The CLI and the shared token use the memories without an owner.
+	state.User = *user
+	if *shouldListMemories {
+		fmt.Println(listMemories(state, *memoryTag))
+		return
+	}
 	state.Logger.Info("Run started")
+	if *userToAdd != "" {
+		if err := addUser(db, *userToAdd, getPassword()); err != nil {
+			fmt.Println("Failed to add user:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("User %s can log in now\n", *userToAdd)
+		return
+	}
+	if *userToDelete != "" {
+		if err := deleteUser(db, *userToDelete); err != nil {
+			fmt.Println("Failed to delete user:", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if *memoryToDelete != "" {
-		deleteMemory(state, *memoryToDelete)
+		if err := deleteMemory(state, *memoryToDelete); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *shouldGcMemories {
+		fmt.Println(gcMemories(state))
 		return
 	}
 	if *memoryToLoad != "" {
@@ -507,9 +1059,27 @@ func main() {
 		fmt.Println(resumeLastMemory(state))
 	}
 
+	if *serveMCPFlag {
+		if err := serveMCP(state); err != nil {
+			state.Logger.Error("MCP server stopped", slog.Any("err", err))
+			fmt.Fprintln(os.Stderr, "MCP server stopped:", err)
+			os.Exit(1)
+		}
+		return
+	}
+	connectMCPServers(state)
+	defer closeMCPConnections(state)
 	if *webServer {
-		state.OperatingMode = Normal
-		webHandler(state)
+		webHandler(state, WebOptions{
+			Listen:         *listen,
+			SessionTimeout: *sessionTimeout,
+			Token:          *webToken,
+			TLSCert:        *tlsCert,
+			TLSKey:         *tlsKey,
+			SelfSigned:     *tlsSelfSigned,
+			TrustedProxies: parseTrustedProxies(*trustedProxies),
+			BasePath:       normalizeBasePath(*basePath),
+		})
 	} else {
 		cliHandler(state)
 	}
@@ -522,7 +1092,5 @@ func getenv(k, def string) string {
 	return def
 }
 
-//TODO: enable memory exporting
 //TODO: auto-complete for inline commands
-//TODO: Add dropdown for mode selection for mobile use
 //TODO: Add memory button to see the whole memory for mobile
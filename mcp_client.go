@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+const mcpConnectTimeout = 30 * time.Second
+
+// MCPServer is an MCP server from the config file, it is started with Command
+// and talked to over stdio, or reached over HTTP at Url.
+type MCPServer struct {
+	Command string            `yaml:"command"`
+	Args    []string          `yaml:"args"`
+	Env     map[string]string `yaml:"env"`
+	Url     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+	Timeout time.Duration     `yaml:"timeout"`
+}
+
+func (self MCPServer) Validate() error {
+	if (self.Command == "") == (self.Url == "") {
+		return fmt.Errorf("needs either a command or a url")
+	}
+	return nil
+}
+
+// MCPConnection is a connected MCP server and the tools it offers.
+type MCPConnection struct {
+	Name    string
+	Server  MCPServer
+	Session *mcp.ClientSession
+	Tools   []*mcp.Tool
+}
+
+// headerTransport adds the configured headers to every request to an HTTP
+// MCP server.
+type headerTransport struct {
+	headers map[string]string
+}
+
+func (self headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, value := range self.headers {
+		req.Header.Set(key, value)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (self MCPServer) transport() mcp.Transport {
+	if self.Url != "" {
+		return &mcp.StreamableClientTransport{
+			Endpoint:   self.Url,
+			HTTPClient: &http.Client{Transport: headerTransport{headers: self.Headers}},
+		}
+	}
+	command := exec.Command(self.Command, self.Args...)
+	command.Env = os.Environ()
+	for key, value := range self.Env {
+		command.Env = append(command.Env, key+"="+value)
+	}
+	return &mcp.CommandTransport{Command: command}
+}
+
+func connectMCPServer(name string, server MCPServer) (*MCPConnection, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mcpConnectTimeout)
+	defer cancel()
+
+	client := mcp.NewClient(&mcp.Implementation{Name: "yaap", Version: "1.0.0"}, nil)
+	session, err := client.Connect(ctx, server.transport(), nil)
+	if err != nil {
+		return nil, err
+	}
+	connection := &MCPConnection{Name: name, Server: server, Session: session}
+	for tool, err := range session.Tools(ctx, nil) {
+		if err != nil {
+			session.Close()
+			return nil, fmt.Errorf("failed to list tools: %w", err)
+		}
+		connection.Tools = append(connection.Tools, tool)
+	}
+	return connection, nil
+}
+
+// connectMCPServers connects to every MCP server of the config, servers that
+// fail to connect are skipped.
+func connectMCPServers(state *State) {
+	names := make([]string, 0, len(state.Config.MCPServers))
+	for name := range state.Config.MCPServers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		server := state.Config.MCPServers[name]
+		connection, err := connectMCPServer(name, server)
+		if err != nil {
+			state.Logger.Error("Failed to connect to MCP server", slog.String("server", name), slog.Any("err", err))
+			fmt.Printf("Failed to connect to MCP server %s: %s\n", name, err)
+			continue
+		}
+		state.Logger.Info("Connected to MCP server", slog.String("server", name), slog.Int("tools", len(connection.Tools)))
+		state.MCPConnections = append(state.MCPConnections, connection)
+	}
+}
+
+func closeMCPConnections(state *State) {
+	for _, connection := range state.MCPConnections {
+		if err := connection.Session.Close(); err != nil {
+			state.Logger.Warn("Failed to close MCP server", slog.String("server", connection.Name), slog.Any("err", err))
+		}
+	}
+	state.MCPConnections = nil
+}
+
+func mcpToolName(server string, tool string) string {
+	return server + "__" + tool
+}
+
+// getMCPTools turns the tools of the connected MCP servers into tools the
+// agent mode can call.
+func getMCPTools(state *State) []AgentTool {
+	var tools []AgentTool
+	for _, connection := range state.MCPConnections {
+		for _, tool := range connection.Tools {
+			tools = append(tools, AgentTool{
+				Name:        mcpToolName(connection.Name, tool.Name),
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+				Run: func(state *State, client *http.Client, arguments json.RawMessage) (string, error) {
+					return callMCPTool(connection, tool.Name, arguments)
+				},
+			})
+		}
+	}
+	return tools
+}
+
+func callMCPTool(connection *MCPConnection, name string, arguments json.RawMessage) (string, error) {
+	timeout := connection.Server.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if len(arguments) == 0 {
+		arguments = json.RawMessage("{}")
+	}
+	result, err := connection.Session.CallTool(ctx, &mcp.CallToolParams{Name: name, Arguments: arguments})
+	if err != nil {
+		return "", err
+	}
+	var content strings.Builder
+	for _, item := range result.Content {
+		switch item := item.(type) {
+		case *mcp.TextContent:
+			fmt.Fprintf(&content, "%s\n", item.Text)
+		case *mcp.EmbeddedResource:
+			if item.Resource != nil {
+				fmt.Fprintf(&content, "%s\n", item.Resource.Text)
+			}
+		default:
+			fmt.Fprintf(&content, "[%T content left out]\n", item)
+		}
+	}
+	if result.IsError {
+		return "", fmt.Errorf("%s", strings.TrimSpace(content.String()))
+	}
+	return content.String(), nil
+}
+
+func listTools(state *State) string {
+	var tools strings.Builder
+	fmt.Fprintf(&tools, "Tools\n\nEvery mode\n\n")
+	for _, tool := range builtinTools {
+		fmt.Fprintf(&tools, "%s | %s\n\n", tool.Name, tool.Description)
+	}
+	fmt.Fprintf(&tools, "Agent mode\n\n")
+	for _, tool := range webTools {
+		fmt.Fprintf(&tools, "%s | %s\n\n", tool.Name, tool.Description)
+	}
+	for _, connection := range state.MCPConnections {
+		fmt.Fprintf(&tools, "MCP server %s\n\n", connection.Name)
+		for _, tool := range connection.Tools {
+			fmt.Fprintf(&tools, "%s | %s\n\n", mcpToolName(connection.Name, tool.Name), tool.Description)
+		}
+	}
+	return tools.String()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+type MCPQuestionInput struct {
+	Question string `json:"question" jsonschema:"the question to answer"`
+}
+type MCPListMemoriesInput struct {
+	Tag string `json:"tag,omitempty" jsonschema:"only list memories with this tag"`
+}
+type MCPGetMemoryInput struct {
+	Id string `json:"id" jsonschema:"id of the memory as shown by list_memories"`
+}
+
+// mcpModeTools are the modes served as MCP tools.
+var mcpModeTools = []struct {
+	Name        string
+	Mode        OperatingMode
+	Description string
+}{
+	{"research", Research, "Research a question by crawling the web, returns a sourced answer"},
+	{"search", Search, "Answer a question from quick web search results, good for current information"},
+	{"code_lookup", Code, "Look up documentation and code examples on the web and answer a programming question"},
+}
+
+// serveMCP serves YAAP's modes and memories as MCP tools over stdio until the
+// client disconnects. Stdout belongs to the protocol so everything the modes
+// print goes to stderr instead.
+func serveMCP(state *State) error {
+	protocolOut := os.Stdout
+	os.Stdout = os.Stderr
+
+	// Tool calls share the state, so only one runs at a time.
+	var lock sync.Mutex
+	server := mcp.NewServer(&mcp.Implementation{Name: "yaap", Version: "1.0.0"}, nil)
+	for _, tool := range mcpModeTools {
+		mcp.AddTool(server, &mcp.Tool{Name: tool.Name, Description: tool.Description}, func(ctx context.Context, request *mcp.CallToolRequest, input MCPQuestionInput) (*mcp.CallToolResult, any, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			state.Logger.Info("MCP tool called", slog.String("tool", tool.Name))
+			return textResult(answerWithSources(answerWithMode(state, tool.Mode, Memory{}, input.Question))), nil, nil
+		})
+	}
+	mcp.AddTool(server, &mcp.Tool{Name: "list_memories", Description: "List the saved conversations with their ids"}, func(ctx context.Context, request *mcp.CallToolRequest, input MCPListMemoriesInput) (*mcp.CallToolResult, any, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return textResult(listMemories(state, input.Tag)), nil, nil
+	})
+	mcp.AddTool(server, &mcp.Tool{Name: "get_memory", Description: "Get a saved conversation by its id"}, func(ctx context.Context, request *mcp.CallToolRequest, input MCPGetMemoryInput) (*mcp.CallToolResult, any, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		memory, err := readUserMemory(state, input.Id)
+		if err != nil {
+			return nil, nil, fmt.Errorf("memory %s wasn't found", input.Id)
+		}
+		return textResult(getMemoryMarkdown(memory)), nil, nil
+	})
+
+	state.Logger.Info("Serving MCP over stdio")
+	return server.Run(context.Background(), &mcp.IOTransport{Reader: os.Stdin, Writer: protocolOut})
+}
+
+func textResult(text string) *mcp.CallToolResult {
+	return &mcp.CallToolResult{Content: []mcp.Content{&mcp.TextContent{Text: text}}}
+}
+
+func answerWithSources(answer FinalAnswer) string {
+	if len(answer.Sources) == 0 {
+		return answer.FinalAnswer
+	}
+	return fmt.Sprintf("%s\n\nSources:\n%s", answer.FinalAnswer, strings.Join(answer.Sources, "\n"))
+}
+
+func getMemoryMarkdown(memory Memory) string {
+	var markdown strings.Builder
+	fmt.Fprintf(&markdown, "# %s\n\n", memory.Title)
+	for _, interaction := range memory.Interactions {
+		fmt.Fprintf(&markdown, "## %s\n\n", interaction.Question)
+		if metadata := interaction.GetMetadata(); metadata != "" {
+			fmt.Fprintf(&markdown, "_%s_\n\n", metadata)
+		}
+		fmt.Fprintf(&markdown, "%s\n\n", interaction.Answer)
+		if len(interaction.Links) > 0 {
+			fmt.Fprintf(&markdown, "Sources:\n%s\n\n", strings.Join(interaction.Links, "\n"))
+		}
+	}
+	return markdown.String()
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
@@ -16,6 +19,10 @@ import (
 const memoriesDbName string = ".memories.db"
 const memoriesDirectoryName string = ".memories"
 
+// readableMemories matches the memories the user owns or that are shared with
+// them, it takes the user twice.
+const readableMemories string = "(owner = ? OR id IN (SELECT memory_id FROM memory_shares WHERE user = ?))"
+
 func saveMemory(state *State) {
 	state.Logger.Debug("Saving current memory", slog.String("memory_id", state.Memory.Id))
 	if len(state.Memory.Interactions) == 0 {
@@ -24,42 +31,117 @@ func saveMemory(state *State) {
 	if state.Memory.Id == "" {
 		state.Memory.Id = uuid.New().String()
 	}
-	dir := memoriesDirectoryName
-	filePath := filepath.Join(dir, state.Memory.Id)
-	if err := os.MkdirAll(dir, 0755); err != nil {
-		state.Logger.Error("Failed to make memory directory", slog.Any("err", err))
+	if !ownsMemory(state, state.Memory.Id) {
+		state.Logger.Warn("Not saving a memory shared read-only", slog.String("memory_id", state.Memory.Id))
+		return
 	}
-
-	file, err := os.Create(filePath)
-	if err != nil {
-		state.Logger.Error("Failed to save memory to directory", slog.Any("err", err))
+	if err := os.MkdirAll(memoriesDirectory(state.Settings.DataDir), 0755); err != nil {
+		state.Logger.Error("Failed to make memory directory", slog.Any("err", err))
 	}
 
-	defer file.Close()
-
-	encoder := gob.NewEncoder(file)
+	var encoded bytes.Buffer
+	encoder := gob.NewEncoder(&encoded)
 
 	if err := encoder.Encode(state.Memory); err != nil {
 		state.Logger.Error("Failed to encode memory struct", slog.Any("err", err))
 	}
+	err := os.WriteFile(memoryFilePath(state.Settings.DataDir, state.Memory.Id), state.Cipher.Seal(encoded.Bytes()), 0600)
+	if err != nil {
+		state.Logger.Error("Failed to save memory to directory", slog.Any("err", err))
+	}
 	_, err = state.Database.Exec(
-		`INSERT INTO memories (id, title, updated) 
-		 VALUES (?, ?, ?)
+		`INSERT INTO memories (id, title, updated, parent_id, owner) 
+		 VALUES (?, ?, ?, ?, ?)
 		 ON CONFLICT (id) DO UPDATE
 		 SET 
-			updated = excluded.updated`,
-		state.Memory.Id, state.Memory.Title, time.Now().Unix())
+			updated = excluded.updated,
+			title = excluded.title`,
+		state.Memory.Id, state.Cipher.SealString(state.Memory.Title), time.Now().Unix(), state.Memory.ParentId, state.User)
 	if err != nil {
 		state.Logger.Error("Failed to insert memory into db", slog.Any("err", err))
 	}
 }
-func deleteMemory(state *State, memoryId string) {
+func memoriesDirectory(dataDir string) string {
+	return filepath.Join(dataDir, memoriesDirectoryName)
+}
+func memoryFilePath(dataDir string, memoryId string) string {
+	return filepath.Join(memoriesDirectory(dataDir), memoryId)
+}
+func readMemoryFile(state *State, memoryId string) (Memory, error) {
+	var memory Memory
+	content, err := os.ReadFile(memoryFilePath(state.Settings.DataDir, memoryId))
+	if err != nil {
+		return memory, err
+	}
+	decrypted, err := state.Cipher.Open(content)
+	if err != nil {
+		return memory, err
+	}
+	err = gob.NewDecoder(bytes.NewReader(decrypted)).Decode(&memory)
+	return memory, err
+}
+
+// readUserMemory reads a memory the current user owns or that is shared with
+// them.
+func readUserMemory(state *State, memoryId string) (Memory, error) {
+	if !canReadMemory(state, memoryId) {
+		return Memory{}, fmt.Errorf("memory %s wasn't found", memoryId)
+	}
+	return readMemoryFile(state, memoryId)
+}
+
+// ownsMemory reports whether the current user can change the memory, a
+// memory that isn't saved yet belongs to whoever is using it.
+func ownsMemory(state *State, memoryId string) bool {
+	var owner string
+	err := state.Database.QueryRow("SELECT owner FROM memories WHERE id=?", memoryId).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true
+	}
+	if err != nil {
+		state.Logger.Error("Failed to read memory owner", slog.Any("err", err))
+		return false
+	}
+	return owner == state.User
+}
+
+func canReadMemory(state *State, memoryId string) bool {
+	var count int
+	err := state.Database.QueryRow(
+		"SELECT COUNT(*) FROM memories WHERE id=? AND "+readableMemories,
+		memoryId, state.User, state.User,
+	).Scan(&count)
+	if err != nil {
+		state.Logger.Error("Failed to check memory access", slog.Any("err", err))
+		return false
+	}
+	return count > 0
+}
+
+// deleteMemory deletes a memory of the current user.
+func deleteMemory(state *State, memoryId string) error {
+	if !canReadMemory(state, memoryId) {
+		return fmt.Errorf("memory %s wasn't found", memoryId)
+	}
+	if !ownsMemory(state, memoryId) {
+		return fmt.Errorf("memory %s is shared with you read-only", memoryId)
+	}
+	removeMemory(state, memoryId)
+	return nil
+}
+
+// removeMemory removes a memory whoever owns it.
+func removeMemory(state *State, memoryId string) {
 	state.Logger.Debug("Deleting memory", slog.String("memory_id", memoryId))
-	filePath := filepath.Join(memoriesDirectoryName, memoryId)
+	filePath := memoryFilePath(state.Settings.DataDir, memoryId)
 	_, err := state.Database.Exec("DELETE FROM memories WHERE id=?", memoryId)
 	if err != nil {
 		state.Logger.Error("Failed to delete memory from DB", slog.Any("err", err))
 	}
+	_, err = state.Database.Exec("DELETE FROM memory_shares WHERE memory_id=?", memoryId)
+	if err != nil {
+		state.Logger.Error("Failed to delete memory shares from DB", slog.Any("err", err))
+	}
 	err = os.Remove(filePath)
 	if err != nil {
 		state.Logger.Error("Failed to delete memory from disk", slog.Any("err", err))
@@ -71,20 +153,291 @@ func forgetMemory(state *State) {
 	state.Memory.Interactions = []ChatInteraction{}
 	state.Memory.Title = ""
 }
+func addInteraction(state *State, prompt string, answer FinalAnswer) {
+	if len(state.Memory.Interactions) == 0 {
+		state.Memory.Title = generateMemoryTitle(state, prompt, answer.FinalAnswer)
+		state.Memory.Id = uuid.New().String()
+	} else if !ownsMemory(state, state.Memory.Id) {
+		// A memory shared with the user is read-only, following up on it
+		// continues in a copy of their own.
+		state.Memory.ParentId, state.Memory.Id = state.Memory.Id, uuid.New().String()
+	}
+	state.Memory.Interactions = append(state.Memory.Interactions, newChatInteraction(state, prompt, answer))
+}
+func newChatInteraction(state *State, prompt string, answer FinalAnswer) ChatInteraction {
+	return ChatInteraction{
+		Question:        prompt,
+		Answer:          answer.FinalAnswer,
+		Links:           answer.Sources,
+		Mode:            answer.Mode,
+		RoutedMode:      answer.RoutedMode,
+		ModeName:        answer.Mode.String(),
+		RoutedModeName:  answer.RoutedMode.String(),
+		Model:           answer.Model,
+		LightModel:      state.Settings.LightModel,
+		Timestamp:       time.Now(),
+		PromptEvalCount: answer.PromptEvalCount,
+		EvalCount:       answer.EvalCount,
+		Latency:         answer.Latency,
+		FileName:        state.FileName,
+		ToolCalls:       answer.ToolCalls,
+	}
+}
+func listInteractions(state *State) string {
+	var interactions strings.Builder
+	fmt.Fprintf(&interactions, "Interactions\n\n")
+	for index, interaction := range state.Memory.Interactions {
+		question := strings.ReplaceAll(interaction.Question, "\n", "\\n")
+		if len(question) > 100 {
+			question = question[:100]
+		}
+		fmt.Fprintf(&interactions, "%d | %s | %s\n\n", index, interaction.GetModeName(), question)
+	}
+	return interactions.String()
+}
+func deleteInteraction(state *State, index int) {
+	state.Logger.Debug("Deleting interaction", slog.String("memory_id", state.Memory.Id), slog.Int("index", index))
+	state.Memory.Interactions = append(state.Memory.Interactions[:index], state.Memory.Interactions[index+1:]...)
+}
+
+// regenerateInteraction answers question again with only the interactions
+// before index as history and the file the interaction was answered with, and
+// replaces the interaction at index with the result.
+func regenerateInteraction(state *State, index int, question string, mode OperatingMode) (string, error) {
+	if _, ok := getModeInfo(mode); !ok {
+		return "", fmt.Errorf("there is no mode %s, pick one with -m", mode.String())
+	}
+	state.Logger.Debug("Regenerating interaction", slog.String("memory_id", state.Memory.Id), slog.Int("index", index))
+	interactions := state.Memory.Interactions
+	previousMode, previousFile := state.OperatingMode, state.FileName
+	state.Memory.Interactions = interactions[:index:index]
+	state.OperatingMode, state.FileName = mode, interactions[index].FileName
+
+	answer := executePrompt(state, question)
+
+	state.Memory.Interactions = interactions
+	state.Memory.Interactions[index] = newChatInteraction(state, question, answer)
+	state.OperatingMode, state.FileName = previousMode, previousFile
+	if index == 0 {
+		state.Memory.Title = generateMemoryTitle(state, question, answer.FinalAnswer)
+	}
+	return state.Memory.Interactions[index].GetPrinted(state.Renderer), nil
+}
 func rememberMemory(state *State) {
 	state.Logger.Debug("Remembering chat")
 	state.Remember = true
 }
 
+func forkMemory(state *State, index int) error {
+	state.Logger.Debug("Forking memory", slog.String("memory_id", state.Memory.Id), slog.Int("index", index))
+	if index < 0 || index >= len(state.Memory.Interactions) {
+		return fmt.Errorf("interaction index %d is out of range, memory has %d interactions", index, len(state.Memory.Interactions))
+	}
+	saveMemory(state)
+
+	interactions := make([]ChatInteraction, index+1)
+	copy(interactions, state.Memory.Interactions[:index+1])
+	state.Memory = Memory{
+		Title:        state.Memory.Title,
+		Id:           uuid.New().String(),
+		ParentId:     state.Memory.Id,
+		Interactions: interactions,
+	}
+	rememberMemory(state)
+	saveMemory(state)
+	return nil
+}
+
+// generateMemoryTitle asks the light model for a short title and falls back
+// to the question itself when the model doesn't give a usable one.
+func generateMemoryTitle(state *State, question string, answer string) string {
+	response := callLightLLM(
+		state,
+		Titling,
+		fmt.Sprintf(`
+		[question]
+		%s
+		[answer]
+		%s
+		`, question, answer),
+		renderPrompt(state, TitlePrompt),
+	)
+	title := strings.Trim(strings.TrimSpace(response.Response), "\"'`.")
+	if title == "" || strings.Contains(title, "\n") || len(title) > 100 {
+		return question
+	}
+	return title
+}
+func renameMemory(state *State, title string) string {
+	if len(state.Memory.Interactions) == 0 {
+		return "There is nothing to rename in this memory yet"
+	}
+	if !ownsMemory(state, state.Memory.Id) {
+		return sharedReadOnly
+	}
+	if title == "" {
+		title = generateMemoryTitle(state, state.Memory.Interactions[0].Question, state.Memory.Interactions[0].Answer)
+	}
+	state.Logger.Debug("Renaming memory", slog.String("memory_id", state.Memory.Id), slog.String("title", title))
+	state.Memory.Title = title
+	saveMemory(state)
+	return fmt.Sprintf("Renamed memory to %s", title)
+}
+func getMemoryTags(state *State, memoryId string) []string {
+	var sealedTags string
+	state.Database.QueryRow("SELECT tags FROM memories WHERE id=?", memoryId).Scan(&sealedTags)
+	tags, err := state.Cipher.OpenString(sealedTags)
+	if err != nil {
+		state.Logger.Error("Failed to decrypt memory tags", slog.Any("err", err))
+	}
+	if tags == "" {
+		return []string{}
+	}
+	return strings.Split(tags, ",")
+}
+func setMemoryTags(state *State, tags []string) {
+	_, err := state.Database.Exec("UPDATE memories SET tags=? WHERE id=?", state.Cipher.SealString(strings.Join(tags, ",")), state.Memory.Id)
+	if err != nil {
+		state.Logger.Error("Failed to update memory tags", slog.Any("err", err))
+	}
+}
+func tagMemory(state *State, tag string) string {
+	tag = strings.ReplaceAll(strings.TrimSpace(tag), ",", "")
+	if tag == "" {
+		return "Please provide a tag"
+	}
+	if len(state.Memory.Interactions) == 0 {
+		return "There is nothing to tag in this memory yet"
+	}
+	if !ownsMemory(state, state.Memory.Id) {
+		return sharedReadOnly
+	}
+	saveMemory(state)
+	tags := getMemoryTags(state, state.Memory.Id)
+	if slices.Contains(tags, tag) {
+		return fmt.Sprintf("Memory is already tagged with %s", tag)
+	}
+	setMemoryTags(state, append(tags, tag))
+	return fmt.Sprintf("Tagged memory with %s", tag)
+}
+func untagMemory(state *State, tag string) string {
+	tag = strings.TrimSpace(tag)
+	if !ownsMemory(state, state.Memory.Id) {
+		return sharedReadOnly
+	}
+	tags := getMemoryTags(state, state.Memory.Id)
+	index := slices.Index(tags, tag)
+	if index == -1 {
+		return fmt.Sprintf("Memory isn't tagged with %s", tag)
+	}
+	setMemoryTags(state, slices.Delete(tags, index, index+1))
+	return fmt.Sprintf("Removed tag %s from memory", tag)
+}
+func pinMemory(state *State, pinned bool) string {
+	if len(state.Memory.Interactions) == 0 {
+		return "There is nothing to pin in this memory yet"
+	}
+	if !ownsMemory(state, state.Memory.Id) {
+		return sharedReadOnly
+	}
+	saveMemory(state)
+	_, err := state.Database.Exec("UPDATE memories SET pinned=? WHERE id=?", pinned, state.Memory.Id)
+	if err != nil {
+		state.Logger.Error("Failed to update memory pin", slog.Any("err", err))
+	}
+	if pinned {
+		return "Pinned memory"
+	}
+	return "Unpinned memory"
+}
+
 type MemoryDto struct {
-	Id      string
-	Title   string
-	Updated int64
+	Id       string `json:"id"`
+	Title    string `json:"title"`
+	Updated  int64  `json:"updated"`
+	ParentId string `json:"parent_id"`
+	Tags     string `json:"tags"`
+	Pinned   bool   `json:"pinned"`
+	Owner    string `json:"owner"`
+}
+
+const sharedReadOnly = "This memory is shared with you read-only"
+
+// memorySearchMaxMatches caps the interactions read when filtering memories.
+const memorySearchMaxMatches = 200
+
+// shareMemory lets another user read a memory of the current user.
+func shareMemory(state *State, memoryId string, user string) error {
+	var owner string
+	err := state.Database.QueryRow("SELECT owner FROM memories WHERE id=?", memoryId).Scan(&owner)
+	if err != nil {
+		return fmt.Errorf("memory %s wasn't found", memoryId)
+	}
+	if owner != state.User {
+		return errors.New(sharedReadOnly)
+	}
+	if !userExists(state.Database, user) || user == state.User {
+		return fmt.Errorf("there is no other user %s", user)
+	}
+	_, err = state.Database.Exec("INSERT OR IGNORE INTO memory_shares (memory_id, user) VALUES (?, ?)", memoryId, user)
+	return err
+}
+
+func unshareMemory(state *State, memoryId string, user string) error {
+	if !ownsMemory(state, memoryId) {
+		return errors.New(sharedReadOnly)
+	}
+	result, err := state.Database.Exec("DELETE FROM memory_shares WHERE memory_id=? AND user=?", memoryId, user)
+	if err != nil {
+		return err
+	}
+	if unshared, _ := result.RowsAffected(); unshared == 0 {
+		return fmt.Errorf("memory isn't shared with %s", user)
+	}
+	return nil
+}
+
+func getMemoryShares(state *State, memoryId string) []string {
+	shares := []string{}
+	rows, err := state.Database.Query("SELECT user FROM memory_shares WHERE memory_id=? ORDER BY user", memoryId)
+	if err != nil {
+		state.Logger.Error("Failed to list memory shares", slog.Any("err", err))
+		return shares
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var user string
+		if rows.Scan(&user) == nil {
+			shares = append(shares, user)
+		}
+	}
+	return shares
+}
+
+func shareMemoryCommand(state *State, user string, share bool) string {
+	user = strings.TrimSpace(user)
+	if user == "" {
+		return "Please provide a user"
+	}
+	if len(state.Memory.Interactions) == 0 {
+		return "There is nothing to share in this memory yet"
+	}
+	saveMemory(state)
+	if !share {
+		if err := unshareMemory(state, state.Memory.Id, user); err != nil {
+			return err.Error()
+		}
+		return fmt.Sprintf("Stopped sharing memory with %s", user)
+	}
+	if err := shareMemory(state, state.Memory.Id, user); err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("Shared memory read-only with %s", user)
 }
 
 func resumeLastMemory(state *State) string {
 	state.Logger.Debug("Resuming last memory")
-	row := state.Database.QueryRow("SELECT id FROM memories ORDER BY updated DESC LIMIT 1")
+	row := state.Database.QueryRow("SELECT id FROM memories WHERE owner=? ORDER BY updated DESC LIMIT 1", state.User)
 
 	var memoryId string
 	err := row.Scan(&memoryId)
@@ -92,15 +445,7 @@ func resumeLastMemory(state *State) string {
 		state.Logger.Error("Last memory wasn't found in the database", slog.Any("err", err))
 	}
 
-	filePath := filepath.Join(memoriesDirectoryName, memoryId)
-	file, _ := os.Open(filePath)
-	defer file.Close()
-
-	decoder := gob.NewDecoder(file)
-
-	var memory Memory
-
-	err = decoder.Decode(&memory)
+	memory, err := readMemoryFile(state, memoryId)
 	if err != nil {
 		state.Logger.Error("Last memory wasn't found on the disk", slog.Any("err", err))
 	}
@@ -108,18 +453,115 @@ func resumeLastMemory(state *State) string {
 	return state.Memory.GetPrintedMemory(state.Renderer)
 
 }
-func listMemories(database *sql.DB) string {
-	rows, err := database.Query("SELECT * FROM memories ORDER BY updated")
+
+type MemoryMatch struct {
+	MemoryId string
+	Title    string
+	Question string
+	Answer   string
+}
+
+// searchMemories finds interactions of other memories that have every word
+// of the query in them, newest memories first.
+func searchMemories(state *State, query string, limit int) []MemoryMatch {
+	words := strings.Fields(strings.ToLower(query))
+	if len(words) == 0 {
+		return nil
+	}
+	rows, err := state.Database.Query("SELECT id FROM memories WHERE "+readableMemories+" ORDER BY updated DESC", state.User, state.User)
+	if err != nil {
+		state.Logger.Error("Failed to search memories", slog.Any("err", err))
+		return nil
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil && id != state.Memory.Id {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	var matches []MemoryMatch
+	for _, id := range ids {
+		memory, err := readMemoryFile(state, id)
+		if err != nil {
+			state.Logger.Warn("Failed to read memory while searching", slog.String("memory_id", id), slog.Any("err", err))
+			continue
+		}
+		for _, interaction := range memory.Interactions {
+			text := strings.ToLower(interaction.Question + "\n" + interaction.Answer)
+			if !containsAll(text, words) {
+				continue
+			}
+			matches = append(matches, MemoryMatch{
+				MemoryId: id,
+				Title:    memory.Title,
+				Question: interaction.Question,
+				Answer:   interaction.Answer,
+			})
+			if len(matches) >= limit {
+				return matches
+			}
+		}
+	}
+	return matches
+}
+
+// filterMemories keeps the memories whose title or tags have the query in
+// them or that have an interaction matching it.
+func filterMemories(state *State, memories []MemoryDto, query string) []MemoryDto {
+	found := make(map[string]bool)
+	for _, match := range searchMemories(state, query, memorySearchMaxMatches) {
+		found[match.MemoryId] = true
+	}
+	words := strings.Fields(strings.ToLower(query))
+	var filtered []MemoryDto
+	for _, memory := range memories {
+		if found[memory.Id] || containsAll(strings.ToLower(memory.Title+" "+memory.Tags), words) {
+			filtered = append(filtered, memory)
+		}
+	}
+	return filtered
+}
+func containsAll(text string, words []string) bool {
+	for _, word := range words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+// getMemories returns the memories of the current user and the ones shared
+// with them with tag, or all of them if tag is empty, pinned memories first
+// and then oldest first.
+func getMemories(state *State, tag string) ([]MemoryDto, error) {
+	rows, err := state.Database.Query(
+		`SELECT id, title, updated, parent_id, tags, pinned, owner FROM memories
+		 WHERE `+readableMemories+`
+		 ORDER BY pinned DESC, updated`,
+		state.User, state.User,
+	)
 
 	if err != nil {
-		panic(fmt.Sprintf("Failed to list memories in DB, err: %s", err))
+		return nil, fmt.Errorf("failed to list memories in DB: %w", err)
 	}
 	defer rows.Close()
 	var memories []MemoryDto
 	for rows.Next() {
 		var memory MemoryDto
-		if err := rows.Scan(&memory.Id, &memory.Title, &memory.Updated); err != nil {
-			panic(fmt.Sprintf("Failed to retreive memories from result, err: %s", err))
+		if err := rows.Scan(&memory.Id, &memory.Title, &memory.Updated, &memory.ParentId, &memory.Tags, &memory.Pinned, &memory.Owner); err != nil {
+			return nil, fmt.Errorf("failed to retreive memories from result: %w", err)
+		}
+		if memory.Title, err = state.Cipher.OpenString(memory.Title); err != nil {
+			return nil, fmt.Errorf("failed to decrypt memory title: %w", err)
+		}
+		if memory.Tags, err = state.Cipher.OpenString(memory.Tags); err != nil {
+			return nil, fmt.Errorf("failed to decrypt memory tags: %w", err)
+		}
+		if tag != "" && !slices.Contains(strings.Split(memory.Tags, ","), tag) {
+			continue
 		}
 
 		memories = append(memories, memory)
@@ -127,33 +569,76 @@ func listMemories(database *sql.DB) string {
 	}
 
 	if err := rows.Err(); err != nil {
-		panic(fmt.Sprintf("Empty result from database, err: %s", err))
+		return nil, fmt.Errorf("empty result from database: %w", err)
 	}
-	var memoriesString strings.Builder
-	fmt.Fprintf(&memoriesString, "Memories\n\n")
+	return memories, nil
+}
+func listMemories(state *State, tag string) string {
+	memories, err := getMemories(state, tag)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	known := make(map[string]struct{}, len(memories))
+	for i, memory := range memories {
+		known[memory.Id] = struct{}{}
+		if memory.Owner != state.User {
+			memories[i].Title = fmt.Sprintf("[shared by %s] %s", ownerName(memory.Owner), memory.Title)
+		}
+	}
+	children := make(map[string][]MemoryDto)
+	var roots []MemoryDto
 	for _, memory := range memories {
-		t := time.Unix(memory.Updated, 0).In(time.Local)
-		title := strings.ReplaceAll(memory.Title, "\n", "\\n")
-		if len(title) > 100 {
-			title = title[:100]
+		if _, ok := known[memory.ParentId]; memory.ParentId != "" && ok {
+			children[memory.ParentId] = append(children[memory.ParentId], memory)
+			continue
 		}
-		fmt.Fprintf(&memoriesString, "%s | %s | %s\n\n", memory.Id, title, t.Format("2006-01-02 15:04:05"))
+		roots = append(roots, memory)
+	}
+
+	var memoriesString strings.Builder
+	fmt.Fprintf(&memoriesString, "Memories\n\n")
+	for _, memory := range roots {
+		writeMemoryTree(&memoriesString, memory, children, 0)
 	}
 	return memoriesString.String()
 
 }
+func writeMemoryTree(out *strings.Builder, memory MemoryDto, children map[string][]MemoryDto, depth int) {
+	t := time.Unix(memory.Updated, 0).In(time.Local)
+	title := strings.ReplaceAll(memory.Title, "\n", "\\n")
+	if len(title) > 100 {
+		title = title[:100]
+	}
+	prefix := ""
+	if depth > 0 {
+		prefix = strings.Repeat("    ", depth-1) + "└── "
+	}
+	if memory.Pinned {
+		title = "[pinned] " + title
+	}
+	fmt.Fprintf(out, "%s%s | %s | %s", prefix, memory.Id, title, t.Format("2006-01-02 15:04:05"))
+	if memory.Tags != "" {
+		fmt.Fprintf(out, " | %s", strings.ReplaceAll(memory.Tags, ",", ", "))
+	}
+	fmt.Fprintf(out, "\n\n")
+	for _, child := range children[memory.Id] {
+		writeMemoryTree(out, child, children, depth+1)
+	}
+}
 
-func loadMemory(state *State, memoryId string) string{
-	state.Logger.Debug("Loading memory", slog.String("memory_id", memoryId))
-	filePath := filepath.Join(memoriesDirectoryName, memoryId)
-	file, _ := os.Open(filePath)
-	defer file.Close()
-
-	decoder := gob.NewDecoder(file)
-
-	var memory Memory
+// ownerName names the owner of a memory, memories of the CLI and of the
+// shared token have no owner.
+func ownerName(owner string) string {
+	if owner == "" {
+		return "local"
+	}
+	return owner
+}
 
-	err := decoder.Decode(&memory)
+func loadMemory(state *State, memoryId string) string {
+	state.Logger.Debug("Loading memory", slog.String("memory_id", memoryId))
+	memory, err := readUserMemory(state, memoryId)
 	if err != nil {
 		state.Logger.Warn("Memory not found", slog.String("memory_id", memoryId))
 	}
@@ -161,8 +646,8 @@ func loadMemory(state *State, memoryId string) string{
 	return state.Memory.GetPrintedMemory(state.Renderer)
 }
 
-func initDb() *sql.DB {
-	db, err := sql.Open("sqlite3", memoriesDbName)
+func initDb(dataDir string) *sql.DB {
+	db, err := sql.Open("sqlite3", filepath.Join(dataDir, memoriesDbName))
 	if err != nil {
 		panic(err)
 	}
@@ -181,5 +666,73 @@ func initDb() *sql.DB {
 
 	}
 
+	addColumnIfMissing(db, "memories", "parent_id", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "memories", "tags", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "memories", "pinned", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "memories", "owner", "TEXT NOT NULL DEFAULT ''")
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS encryption (
+			salt BLOB NOT NULL,
+			passphrase_check BLOB NOT NULL
+		)`,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS users (
+			name TEXT PRIMARY KEY,
+			password_hash TEXT NOT NULL
+		)`,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS memory_shares (
+			memory_id TEXT NOT NULL,
+			user TEXT NOT NULL,
+			PRIMARY KEY (memory_id, user)
+		)`,
+	)
+	if err != nil {
+		panic(err)
+	}
+
 	return db
 }
+
+func addColumnIfMissing(db *sql.DB, table string, column string, definition string) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		panic(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid          int
+			name         string
+			columnType   string
+			notNull      int
+			defaultValue sql.NullString
+			primaryKey   int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &primaryKey); err != nil {
+			panic(err)
+		}
+		if name == column {
+			return
+		}
+	}
+	if err := rows.Err(); err != nil {
+		panic(err)
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	if err != nil {
+		panic(err)
+	}
+}
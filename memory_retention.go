@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// orphanGracePeriod keeps memory files without a row that were written
+// recently, saveMemory writes the file before the row so another session may
+// be saving them right now.
+const orphanGracePeriod = 10 * time.Minute
+
+type RetentionPolicy struct {
+	MaxAge     time.Duration
+	MaxCount   int
+	KeepPinned bool
+}
+
+// gcMemories removes memories that fall outside the retention policy and
+// cleans up database rows without a memory file and memory files without a
+// database row, files written in the last orphanGracePeriod are left alone.
+// The policy only applies to the memories of the current user, the currently
+// loaded memory is never removed.
+func gcMemories(state *State) string {
+	state.Logger.Info("Collecting memories")
+	policy := state.Settings.Retention
+
+	rows, err := state.Database.Query("SELECT id, updated, pinned, owner FROM memories ORDER BY updated DESC")
+	if err != nil {
+		return fmt.Sprintf("Failed to list memories in DB, err: %s", err)
+	}
+	var memories []MemoryDto
+	for rows.Next() {
+		var memory MemoryDto
+		if err := rows.Scan(&memory.Id, &memory.Updated, &memory.Pinned, &memory.Owner); err != nil {
+			rows.Close()
+			return fmt.Sprintf("Failed to retreive memories from result, err: %s", err)
+		}
+		memories = append(memories, memory)
+	}
+	rows.Close()
+
+	var orphanedRows, expired, orphanedFiles int
+	known := make(map[string]struct{}, len(memories))
+	kept := 0
+	for _, memory := range memories {
+		known[memory.Id] = struct{}{}
+		if memory.Id == state.Memory.Id {
+			kept++
+			continue
+		}
+		if _, err := os.Stat(memoryFilePath(state.Settings.DataDir, memory.Id)); errors.Is(err, fs.ErrNotExist) {
+			state.Logger.Info("Removing memory row without a file", slog.String("memory_id", memory.Id))
+			if _, err := state.Database.Exec("DELETE FROM memories WHERE id=?", memory.Id); err != nil {
+				state.Logger.Error("Failed to delete memory from DB", slog.Any("err", err))
+			}
+			if _, err := state.Database.Exec("DELETE FROM memory_shares WHERE memory_id=?", memory.Id); err != nil {
+				state.Logger.Error("Failed to delete memory shares from DB", slog.Any("err", err))
+			}
+			orphanedRows++
+			continue
+		}
+		if memory.Owner != state.User {
+			continue
+		}
+		if memory.Pinned && policy.KeepPinned {
+			kept++
+			continue
+		}
+		tooOld := policy.MaxAge > 0 && time.Since(time.Unix(memory.Updated, 0)) > policy.MaxAge
+		tooMany := policy.MaxCount > 0 && kept >= policy.MaxCount
+		if tooOld || tooMany {
+			removeMemory(state, memory.Id)
+			expired++
+			continue
+		}
+		kept++
+	}
+
+	entries, err := os.ReadDir(memoriesDirectory(state.Settings.DataDir))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		state.Logger.Error("Failed to read memory directory", slog.Any("err", err))
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if _, ok := known[entry.Name()]; ok || entry.Name() == state.Memory.Id {
+			continue
+		}
+		if info, err := entry.Info(); err != nil || time.Since(info.ModTime()) < orphanGracePeriod {
+			continue
+		}
+		state.Logger.Info("Removing memory file without a row", slog.String("memory_id", entry.Name()))
+		if err := os.Remove(memoryFilePath(state.Settings.DataDir, entry.Name())); err != nil {
+			state.Logger.Error("Failed to delete memory from disk", slog.Any("err", err))
+			continue
+		}
+		orphanedFiles++
+	}
+
+	return fmt.Sprintf(
+		"Removed %d expired memories, %d database rows without a file and %d files without a database row",
+		expired, orphanedRows, orphanedFiles,
+	)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type OperatingMode int
+
+const (
+	Research OperatingMode = iota
+	Normal
+	Search
+	Code
+	FastCode
+	Auto
+	Agent
+)
+
+// ModeInfo describes a mode in the registry, Run answers a question and
+// returns the answer with its sources.
+type ModeInfo struct {
+	Mode        OperatingMode
+	Name        string
+	Flag        string
+	Description string
+	Status      string
+	Prompts     []string
+	Run         func(state *State, question string) (*LLMResponse, []string)
+}
+
+// modeRegistry holds every mode by its OperatingMode, the built in modes are
+// registered first so their values never change.
+var modeRegistry []ModeInfo
+
+// builtinModeCount is how many modes are built in. Custom modes get their
+// values from the order of the config, so interactions store mode names too.
+const builtinModeCount = int(Agent) + 1
+
+func init() {
+	modeRegistry = []ModeInfo{
+		{
+			Mode:        Research,
+			Name:        "RESEARCH",
+			Flag:        "r",
+			Description: "research mode (use if you want to have the model deep dive)",
+			Status:      "Researching!",
+			Prompts:     []string{LinkQueriesPrompt, LinkSelectionPrompt, ResearchExtractPrompt, ResearchAnswerPrompt},
+			Run:         researchMode,
+		},
+		{
+			Mode:        Normal,
+			Name:        "NORMAL",
+			Flag:        "n",
+			Description: "normal mode (use if you want the model to reply by itself)",
+			Status:      "Answering from memory!",
+			Prompts:     []string{NormalAnswerPrompt},
+			Run:         normalMode,
+		},
+		{
+			Mode:        Search,
+			Name:        "SEARCH",
+			Flag:        "s",
+			Description: "search mode (use if you want the model to quickly search the web for current information)",
+			Status:      "Looking it up!",
+			Prompts:     []string{SearchQueriesPrompt, SearchAnswerPrompt},
+			Run:         lookupMode,
+		},
+		{
+			Mode:        Code,
+			Name:        "CODE",
+			Flag:        "c",
+			Description: "code mode (Use for accurate code examples with explanations)",
+			Status:      "Coding!",
+			Prompts:     []string{LinkQueriesPrompt, LinkSelectionPrompt, CodeExtractPrompt, CodeAnswerPrompt},
+			Run:         codeMode,
+		},
+		{
+			Mode:        FastCode,
+			Name:        "FASTCODE",
+			Flag:        "fc",
+			Description: "fast code mode (Use for quick code prototyping)",
+			Status:      "Fast Coding!",
+			Prompts:     []string{LinkQueriesPrompt, LinkSelectionPrompt, CodeExtractPrompt},
+			Run:         lightCodeMode,
+		},
+		{
+			Mode:        Auto,
+			Name:        "AUTO",
+			Flag:        "a",
+			Description: "auto mode (the model picks search, research, code or normal for every question)",
+			Status:      "Picking a mode!",
+			Prompts:     []string{AutoRoutePrompt},
+			Run:         autoMode,
+		},
+		{
+			Mode:        Agent,
+			Name:        "AGENT",
+			Flag:        "ag",
+			Description: "agent mode (the model searches, opens pages and reads files and memories by itself until it can answer)",
+			Status:      "Working on it!",
+			Prompts:     []string{AgentPrompt},
+			Run:         agentMode,
+		},
+	}
+}
+
+func registerMode(info ModeInfo) OperatingMode {
+	info.Mode = OperatingMode(len(modeRegistry))
+	modeRegistry = append(modeRegistry, info)
+	return info.Mode
+}
+
+func getModeInfo(mode OperatingMode) (ModeInfo, bool) {
+	if mode < 0 || int(mode) >= len(modeRegistry) {
+		return ModeInfo{}, false
+	}
+	return modeRegistry[mode], true
+}
+
+func (s OperatingMode) String() string {
+	if info, ok := getModeInfo(s); ok {
+		return info.Name
+	}
+
+	return fmt.Sprintf("UNKNOWN(%d)", int(s))
+}
+
+func modeFromFlag(flag string) (OperatingMode, bool) {
+	for _, info := range modeRegistry {
+		if info.Flag != "" && info.Flag == flag {
+			return info.Mode, true
+		}
+	}
+	return Normal, false
+}
+
+// modeByName only accepts a mode's name.
+func modeByName(name string) (OperatingMode, bool) {
+	for _, info := range modeRegistry {
+		if strings.EqualFold(info.Name, name) {
+			return info.Mode, true
+		}
+	}
+	return Normal, false
+}
+
+// modeFromName accepts both a mode's name and its /mode flag.
+func modeFromName(name string) (OperatingMode, bool) {
+	if mode, ok := modeByName(name); ok {
+		return mode, true
+	}
+	return modeFromFlag(name)
+}
+
+func getModeFlags() string {
+	var flags strings.Builder
+	for _, info := range modeRegistry {
+		if info.Flag == "" {
+			fmt.Fprintf(&flags, "\t\t  %s - %s\n", strings.ToLower(info.Name), info.Description)
+			continue
+		}
+		fmt.Fprintf(&flags, "\t\t  %s - %s\n", info.Flag, info.Description)
+	}
+	return flags.String()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const openAIModelPrefix = "yaap-"
+
+// openAIKeepAliveInterval is how often a streamed completion sends a comment
+// while the mode is still working so clients don't time out.
+const openAIKeepAliveInterval = 10 * time.Second
+
+type OpenAIMessage struct {
+	Role string `json:"role"`
+	// Content is either a string or a list of content parts.
+	Content json.RawMessage `json:"content"`
+}
+
+type OpenAIChatRequest struct {
+	Model    string          `json:"model"`
+	Messages []OpenAIMessage `json:"messages"`
+	Stream   bool            `json:"stream"`
+}
+
+type OpenAIModel struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+type OpenAIChoice struct {
+	Index        int                 `json:"index"`
+	Message      *OpenAIReplyMessage `json:"message,omitempty"`
+	Delta        *OpenAIReplyMessage `json:"delta,omitempty"`
+	FinishReason *string             `json:"finish_reason"`
+}
+
+type OpenAIReplyMessage struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+type OpenAIUsage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// OpenAIChatResponse is both a completion and a chunk of a streamed
+// completion, Citations holds the sources of the answer.
+type OpenAIChatResponse struct {
+	Id        string         `json:"id"`
+	Object    string         `json:"object"`
+	Created   int64          `json:"created"`
+	Model     string         `json:"model"`
+	Choices   []OpenAIChoice `json:"choices"`
+	Usage     *OpenAIUsage   `json:"usage,omitempty"`
+	Citations []string       `json:"citations,omitempty"`
+}
+
+func openAIModelName(info ModeInfo) string {
+	return openAIModelPrefix + strings.ToLower(info.Name)
+}
+
+func modeFromOpenAIModel(model string) (OperatingMode, bool) {
+	name, found := strings.CutPrefix(model, openAIModelPrefix)
+	if !found {
+		return Normal, false
+	}
+	return modeFromName(name)
+}
+
+// text returns the text of a message whether its content is a string or a
+// list of content parts.
+func (self OpenAIMessage) text() string {
+	var content string
+	if json.Unmarshal(self.Content, &content) == nil {
+		return content
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	json.Unmarshal(self.Content, &parts)
+	var text []string
+	for _, part := range parts {
+		if part.Type == "text" {
+			text = append(text, part.Text)
+		}
+	}
+	return strings.Join(text, "\n")
+}
+
+// openAIConversation turns the messages of a request into a memory holding
+// the earlier turns and the question to answer.
+func openAIConversation(messages []OpenAIMessage) (Memory, string, error) {
+	memory := Memory{}
+	question := ""
+	for _, message := range messages {
+		switch message.Role {
+		case "user":
+			if question != "" {
+				memory.Interactions = append(memory.Interactions, ChatInteraction{Question: question})
+			}
+			question = message.text()
+		case "assistant":
+			memory.Interactions = append(memory.Interactions, ChatInteraction{Question: question, Answer: message.text()})
+			question = ""
+		}
+	}
+	if strings.TrimSpace(question) == "" {
+		return memory, "", fmt.Errorf("the last message has to be a user message")
+	}
+	return memory, question, nil
+}
+
+func openAIError(c *gin.Context, status int, code string, message string) {
+	c.JSON(status, gin.H{"error": gin.H{
+		"message": message,
+		"type":    "invalid_request_error",
+		"code":    code,
+	}})
+}
+
+func registerOpenAIRoutes(r *gin.RouterGroup, state *State) {
+	started := time.Now().Unix()
+
+	r.GET("/v1/models", func(c *gin.Context) {
+		models := make([]OpenAIModel, 0, len(modeRegistry))
+		for _, info := range modeRegistry {
+			models = append(models, OpenAIModel{
+				Id:      openAIModelName(info),
+				Object:  "model",
+				Created: started,
+				OwnedBy: "yaap",
+			})
+		}
+		c.JSON(http.StatusOK, gin.H{"object": "list", "data": models})
+	})
+
+	r.POST("/v1/chat/completions", func(c *gin.Context) {
+		request := OpenAIChatRequest{}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			openAIError(c, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		mode, ok := modeFromOpenAIModel(request.Model)
+		if !ok {
+			openAIError(c, http.StatusNotFound, "model_not_found", fmt.Sprintf("The model %s does not exist", request.Model))
+			return
+		}
+		memory, question, err := openAIConversation(request.Messages)
+		if err != nil {
+			openAIError(c, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+
+		response := OpenAIChatResponse{
+			Id:      "chatcmpl-" + uuid.New().String(),
+			Created: time.Now().Unix(),
+			Model:   request.Model,
+		}
+		// The tools of the modes search the memories of whoever logged in.
+		requestState := *state
+		if user, ok := c.Get(userContextKey); ok {
+			requestState.User = user.(string)
+		}
+		answers := make(chan FinalAnswer, 1)
+		go func() {
+			state.Logger.Info("OpenAI completion", slog.String("model", request.Model), slog.String("user", requestState.User))
+			answers <- answerWithMode(&requestState, mode, memory, question)
+		}()
+
+		if !request.Stream {
+			answer := <-answers
+			stop := "stop"
+			response.Object = "chat.completion"
+			response.Choices = []OpenAIChoice{{Message: &OpenAIReplyMessage{Role: "assistant", Content: answer.FinalAnswer}, FinishReason: &stop}}
+			response.Usage = openAIUsage(answer)
+			response.Citations = answer.Sources
+			c.JSON(http.StatusOK, response)
+			return
+		}
+
+		// The modes don't stream, so the answer is sent as one chunk when it
+		// is ready and comments keep the connection alive until then.
+		response.Object = "chat.completion.chunk"
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		sendChunk := func(w io.Writer, chunk OpenAIChatResponse) {
+			data, _ := json.Marshal(chunk)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		first := response
+		first.Choices = []OpenAIChoice{{Delta: &OpenAIReplyMessage{Role: "assistant"}}}
+		sendChunk(c.Writer, first)
+		c.Writer.Flush()
+
+		ticker := time.NewTicker(openAIKeepAliveInterval)
+		defer ticker.Stop()
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case answer := <-answers:
+				content := response
+				content.Choices = []OpenAIChoice{{Delta: &OpenAIReplyMessage{Content: answer.FinalAnswer}}}
+				sendChunk(w, content)
+				stop := "stop"
+				last := response
+				last.Choices = []OpenAIChoice{{Delta: &OpenAIReplyMessage{}, FinishReason: &stop}}
+				last.Usage = openAIUsage(answer)
+				last.Citations = answer.Sources
+				sendChunk(w, last)
+				fmt.Fprintf(w, "data: [DONE]\n\n")
+				return false
+			case <-ticker.C:
+				fmt.Fprintf(w, ": still working\n\n")
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	})
+}
+
+func openAIUsage(answer FinalAnswer) *OpenAIUsage {
+	return &OpenAIUsage{
+		PromptTokens:     answer.PromptEvalCount,
+		CompletionTokens: answer.EvalCount,
+		TotalTokens:      answer.PromptEvalCount + answer.EvalCount,
+	}
+}
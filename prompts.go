@@ -0,0 +1,176 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+//go:embed prompts/*.tmpl
+var prompts embed.FS
+
+const (
+	NormalAnswerPrompt    string = "normal_answer"
+	LinkQueriesPrompt     string = "link_queries"
+	LinkSelectionPrompt   string = "link_selection"
+	ResearchExtractPrompt string = "research_extract"
+	ResearchAnswerPrompt  string = "research_answer"
+	CodeExtractPrompt     string = "code_extract"
+	CodeAnswerPrompt      string = "code_answer"
+	SearchQueriesPrompt   string = "search_queries"
+	SearchAnswerPrompt    string = "search_answer"
+	TitlePrompt           string = "title"
+	AutoRoutePrompt       string = "auto_route"
+	AgentPrompt           string = "agent"
+)
+
+// PromptData is what prompt templates can use.
+type PromptData struct {
+	Date     string
+	Month    string
+	Year     int
+	Mode     string
+	FileName string
+	Language string
+}
+
+var fileLanguages = map[string]string{
+	".go":   "Go",
+	".py":   "Python",
+	".rs":   "Rust",
+	".js":   "JavaScript",
+	".ts":   "TypeScript",
+	".java": "Java",
+	".c":    "C",
+	".h":    "C",
+	".cpp":  "C++",
+	".cs":   "C#",
+	".rb":   "Ruby",
+	".php":  "PHP",
+	".sh":   "Bash",
+	".lua":  "Lua",
+	".sql":  "SQL",
+	".kt":   "Kotlin",
+}
+
+func getPromptData(state *State) PromptData {
+	now := time.Now()
+	return PromptData{
+		Date:     now.Format("2006-01-02"),
+		Month:    now.Month().String(),
+		Year:     now.Year(),
+		Mode:     state.OperatingMode.String(),
+		FileName: state.FileName,
+		Language: fileLanguages[strings.ToLower(filepath.Ext(state.FileName))],
+	}
+}
+
+func promptOverridePath(state *State, name string) string {
+	return filepath.Join(state.Settings.PromptsDir, name+".tmpl")
+}
+
+// loadPromptTemplate returns the user's override of a prompt if there is one
+// and the built in prompt otherwise.
+func loadPromptTemplate(state *State, name string) (string, bool, error) {
+	if state.Settings.PromptsDir != "" {
+		content, err := os.ReadFile(promptOverridePath(state, name))
+		if err == nil {
+			return string(content), true, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			state.Logger.Warn("Failed to read prompt override", slog.String("prompt", name), slog.Any("err", err))
+		}
+	}
+	content, err := prompts.ReadFile("prompts/" + name + ".tmpl")
+	return string(content), false, err
+}
+
+// promptExists reports whether there is a built in prompt called name or an
+// override of it in promptsDir.
+func promptExists(promptsDir string, name string) bool {
+	if _, err := prompts.Open("prompts/" + name + ".tmpl"); err == nil {
+		return true
+	}
+	if promptsDir == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(promptsDir, name+".tmpl"))
+	return err == nil
+}
+
+func executePromptTemplate(name string, content string, data PromptData) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(content)
+	if err != nil {
+		return "", err
+	}
+	var prompt strings.Builder
+	if err := tmpl.Execute(&prompt, data); err != nil {
+		return "", err
+	}
+	return prompt.String(), nil
+}
+
+// renderPrompt renders the system prompt called name, a broken override is
+// logged and the built in prompt is used instead.
+func renderPrompt(state *State, name string) string {
+	content, overridden, err := loadPromptTemplate(state, name)
+	if err != nil {
+		state.Logger.Error("Prompt not found", slog.String("prompt", name), slog.Any("err", err))
+		return ""
+	}
+	data := getPromptData(state)
+	prompt, err := executePromptTemplate(name, content, data)
+	if err == nil {
+		return prompt
+	}
+	state.Logger.Error("Failed to render prompt", slog.String("prompt", name), slog.Bool("override", overridden), slog.Any("err", err))
+	if !overridden {
+		return ""
+	}
+	builtin, _ := prompts.ReadFile("prompts/" + name + ".tmpl")
+	prompt, _ = executePromptTemplate(name, string(builtin), data)
+	return prompt
+}
+
+func showModePrompts(state *State, modeName string) string {
+	mode, ok := modeFromName(modeName)
+	info, found := getModeInfo(mode)
+	if !ok || !found {
+		return fmt.Sprintf("Unknown mode %s", modeName)
+	}
+	previousMode := state.OperatingMode
+	state.OperatingMode = mode
+	defer func() { state.OperatingMode = previousMode }()
+
+	var shown strings.Builder
+	for _, name := range info.Prompts {
+		source := "built in"
+		if _, overridden, _ := loadPromptTemplate(state, name); overridden {
+			source = promptOverridePath(state, name)
+		}
+		fmt.Fprintf(&shown, "## %s (%s)\n\n```\n%s```\n\n", name, source, renderPrompt(state, name))
+	}
+	return shown.String()
+}
+
+func listPrompts(state *State) string {
+	entries, _ := prompts.ReadDir("prompts")
+	var listed strings.Builder
+	fmt.Fprintf(&listed, "Prompts\n\n")
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".tmpl")
+		source := "built in"
+		if _, overridden, _ := loadPromptTemplate(state, name); overridden {
+			source = promptOverridePath(state, name)
+		}
+		fmt.Fprintf(&listed, "%s | %s\n\n", name, source)
+	}
+	return listed.String()
+}
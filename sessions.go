@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/rand"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sessionCookie = "yaap_session"
+	// sessionHeader carries the session of clients that don't keep cookies,
+	// every response sets it to the session that answered.
+	sessionHeader = "X-YAAP-Session"
+	// sessionContextKey is where the middleware puts the session of a request.
+	sessionContextKey = "session"
+	// sessionCookieContextKey is set when the session came from the cookie,
+	// those requests are the ones that need a CSRF token.
+	sessionCookieContextKey = "session_cookie"
+	// maxSessions caps the sessions kept at once, clients that throw their
+	// cookie away start a new session every request.
+	maxSessions = 1000
+)
+
+// Session is one browser or API client of the web server with its own mode,
+// memory and file. Requests of a session run one at a time.
+type Session struct {
+	Id       string
+	State    *State
+	LastUsed time.Time
+	// LoggedIn is set once the session logged in, the user is kept in the
+	// state and empty when it logged in with the shared token.
+	LoggedIn  bool
+	CSRFToken string
+	// UploadDir keeps the files uploaded to the session until it ends.
+	UploadDir string
+	lock      sync.Mutex
+}
+
+// SessionManager hands out sessions made from a base state and ends them once
+// they are idle for longer than IdleTimeout.
+type SessionManager struct {
+	Base        *State
+	IdleTimeout time.Duration
+	sessions    map[string]*Session
+	lock        sync.Mutex
+}
+
+func NewSessionManager(base *State, idleTimeout time.Duration) *SessionManager {
+	return &SessionManager{
+		Base:        base,
+		IdleTimeout: idleTimeout,
+		sessions:    make(map[string]*Session),
+	}
+}
+
+// newSessionState copies the base state so the session can change its mode,
+// memory and profile without touching other sessions. The database, cipher,
+// logger and MCP connections are safe to share. Every session starts a new
+// memory, sessions continuing the same memory would overwrite each other.
+func (self *SessionManager) newSessionState() *State {
+	state := *self.Base
+	state.Renderer = newRenderer()
+	state.Memory = Memory{}
+	state.FileName = ""
+	state.ToolCalls = nil
+	return &state
+}
+
+// logIn makes the session act for user.
+func (self *Session) logIn(user string) {
+	self.LoggedIn = true
+	self.State.User = user
+}
+
+// Get returns the session with id, or a new session when there is none. New
+// sessions aren't kept until keep is called.
+func (self *SessionManager) Get(id string) (*Session, bool) {
+	self.lock.Lock()
+	if session, ok := self.sessions[id]; ok {
+		session.LastUsed = time.Now()
+		self.lock.Unlock()
+		return session, false
+	}
+	self.lock.Unlock()
+	session := &Session{
+		Id:        rand.Text(),
+		State:     self.newSessionState(),
+		LastUsed:  time.Now(),
+		CSRFToken: rand.Text(),
+		UploadDir: filepath.Join(uploadsDirectory(self.Base.Settings.DataDir), rand.Text()),
+	}
+	session.State.FileRoot = session.UploadDir
+	return session, true
+}
+
+// keep stores a new session, making room by ending the least recently used
+// session when there are maxSessions already. Sessions that didn't log in go
+// first.
+func (self *SessionManager) keep(session *Session) {
+	self.lock.Lock()
+	if _, ok := self.sessions[session.Id]; ok {
+		self.lock.Unlock()
+		return
+	}
+	var evicted *Session
+	if len(self.sessions) >= maxSessions {
+		for _, candidate := range self.sessions {
+			if !candidate.lock.TryLock() {
+				continue
+			}
+			if evicted != nil && !evictsBefore(candidate, evicted) {
+				candidate.lock.Unlock()
+				continue
+			}
+			if evicted != nil {
+				evicted.lock.Unlock()
+			}
+			evicted = candidate
+		}
+		if evicted == nil {
+			self.lock.Unlock()
+			self.Base.Logger.Warn("Not keeping a new session, every session is busy", slog.Int("sessions", maxSessions))
+			return
+		}
+		delete(self.sessions, evicted.Id)
+	}
+	self.sessions[session.Id] = session
+	count := len(self.sessions)
+	self.lock.Unlock()
+
+	if evicted != nil {
+		saveMemory(evicted.State)
+		evicted.removeAttachments()
+		evicted.lock.Unlock()
+		self.Base.Logger.Info("Session evicted", slog.String("memory_id", evicted.State.Memory.Id))
+	}
+	self.Base.Logger.Info("Session started", slog.Int("sessions", count))
+}
+
+// evictsBefore reports whether a should make room before b, both have to be
+// locked.
+func evictsBefore(a *Session, b *Session) bool {
+	if a.LoggedIn != b.LoggedIn {
+		return !a.LoggedIn
+	}
+	return a.LastUsed.Before(b.LastUsed)
+}
+
+// Renew gives the session a new id and CSRF token, it is called on login so a
+// session id known from before can't be used to ride along.
+func (self *SessionManager) Renew(session *Session) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.sessions, session.Id)
+	session.Id = rand.Text()
+	session.CSRFToken = rand.Text()
+	self.sessions[session.Id] = session
+}
+
+// forget drops the session without saving it, for callers that hold the
+// session.
+func (self *SessionManager) forget(id string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.sessions, id)
+}
+
+// End saves the memory of the session and forgets it.
+func (self *SessionManager) End(id string) {
+	self.lock.Lock()
+	session, ok := self.sessions[id]
+	delete(self.sessions, id)
+	self.lock.Unlock()
+	if !ok {
+		return
+	}
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	saveMemory(session.State)
+	session.removeAttachments()
+	self.Base.Logger.Info("Session ended", slog.String("memory_id", session.State.Memory.Id))
+}
+
+// expire ends the sessions that weren't used for IdleTimeout, sessions in the
+// middle of a request are left for the next round.
+func (self *SessionManager) expire() {
+	self.lock.Lock()
+	var expired []*Session
+	for id, session := range self.sessions {
+		if time.Since(session.LastUsed) < self.IdleTimeout || !session.lock.TryLock() {
+			continue
+		}
+		delete(self.sessions, id)
+		expired = append(expired, session)
+	}
+	self.lock.Unlock()
+
+	for _, session := range expired {
+		saveMemory(session.State)
+		session.removeAttachments()
+		session.lock.Unlock()
+		self.Base.Logger.Info("Session expired", slog.String("memory_id", session.State.Memory.Id))
+	}
+}
+
+// ExpireIdle ends idle sessions until stop is closed.
+func (self *SessionManager) ExpireIdle(stop <-chan struct{}) {
+	if self.IdleTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(min(self.IdleTimeout, time.Minute))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.expire()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close ends every session, it is called when the web server stops.
+func (self *SessionManager) Close() {
+	self.lock.Lock()
+	ids := make([]string, 0, len(self.sessions))
+	for id := range self.sessions {
+		ids = append(ids, id)
+	}
+	self.lock.Unlock()
+	for _, id := range ids {
+		self.End(id)
+	}
+}
+
+// Middleware finds the session of a request by its cookie or header, starts
+// one if needed and holds the session for the length of the request. A new
+// session is only kept when the request succeeded, so requests turned away
+// by the auth middleware don't leave sessions behind.
+func (self *SessionManager) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(sessionHeader)
+		fromCookie := false
+		if id == "" {
+			id, _ = c.Cookie(sessionCookie)
+			fromCookie = id != ""
+		}
+		session, isNew := self.Get(id)
+		if isNew {
+			fromCookie = false
+			setSessionCookie(c, session)
+		}
+		c.Header(sessionHeader, session.Id)
+
+		session.lock.Lock()
+		defer session.lock.Unlock()
+		c.Set(sessionContextKey, session)
+		c.Set(sessionCookieContextKey, fromCookie)
+		c.Next()
+
+		if isNew && !c.IsAborted() && c.Writer.Status() < http.StatusBadRequest {
+			self.keep(session)
+		}
+		self.lock.Lock()
+		session.LastUsed = time.Now()
+		self.lock.Unlock()
+	}
+}
+
+func setSessionCookie(c *gin.Context, session *Session) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(sessionCookie, session.Id, 0, cookiePath(c), "", isSecureRequest(c), true)
+	c.Header(sessionHeader, session.Id)
+}
+
+func getSession(c *gin.Context) *Session {
+	return c.MustGet(sessionContextKey).(*Session)
+}
+
+// sessionState returns the state of the session of a request.
+func sessionState(c *gin.Context) *State {
+	return getSession(c).State
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+// fullSessionManager returns a manager holding maxSessions sessions, session-0
+// being the least recently used.
+func fullSessionManager(t *testing.T) *SessionManager {
+	base := &State{Logger: slog.New(slog.DiscardHandler), Settings: Settings{DataDir: t.TempDir()}}
+	manager := NewSessionManager(base, time.Hour)
+	start := time.Now().Add(-time.Hour)
+	for i := range maxSessions {
+		id := fmt.Sprintf("session-%d", i)
+		state := *base
+		manager.sessions[id] = &Session{Id: id, State: &state, LastUsed: start.Add(time.Duration(i) * time.Second)}
+	}
+	return manager
+}
+
+func TestSessionEviction(t *testing.T) {
+	tests := []struct {
+		name        string
+		loggedIn    []string
+		busy        []string
+		wantEvicted string
+	}{
+		{"least recently used", nil, nil, "session-0"},
+		{"sessions that didn't log in first", []string{"session-0", "session-1"}, nil, "session-2"},
+		{"busy sessions are skipped", nil, []string{"session-0"}, "session-1"},
+		{"logged in when every session is", allSessionIds(), nil, "session-0"},
+	}
+	for _, test := range tests {
+		manager := fullSessionManager(t)
+		for _, id := range test.loggedIn {
+			manager.sessions[id].LoggedIn = true
+		}
+		for _, id := range test.busy {
+			manager.sessions[id].lock.Lock()
+		}
+		session, isNew := manager.Get("unknown")
+		if !isNew {
+			t.Fatalf("%s: Get of an unknown id returned a kept session", test.name)
+		}
+		manager.keep(session)
+
+		if len(manager.sessions) != maxSessions {
+			t.Errorf("%s: %d sessions kept, want %d", test.name, len(manager.sessions), maxSessions)
+		}
+		if _, ok := manager.sessions[session.Id]; !ok {
+			t.Errorf("%s: the new session wasn't kept", test.name)
+		}
+		if _, ok := manager.sessions[test.wantEvicted]; ok {
+			t.Errorf("%s: %s wasn't evicted", test.name, test.wantEvicted)
+		}
+	}
+}
+
+func TestSessionEvictionWhenEverySessionIsBusy(t *testing.T) {
+	manager := fullSessionManager(t)
+	for _, session := range manager.sessions {
+		session.lock.Lock()
+	}
+	session, _ := manager.Get("unknown")
+	manager.keep(session)
+	if _, ok := manager.sessions[session.Id]; ok {
+		t.Errorf("the new session was kept while every session was busy")
+	}
+	if len(manager.sessions) != maxSessions {
+		t.Errorf("%d sessions kept, want %d", len(manager.sessions), maxSessions)
+	}
+}
+
+func allSessionIds() []string {
+	ids := make([]string, 0, maxSessions)
+	for i := range maxSessions {
+		ids = append(ids, fmt.Sprintf("session-%d", i))
+	}
+	return ids
+}
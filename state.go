@@ -2,8 +2,10 @@ package main
 
 import (
 	"database/sql"
+	"errors"
 	"log/slog"
 	"os"
+	"path/filepath"
 
 	"github.com/charmbracelet/glamour"
 )
@@ -16,15 +18,28 @@ type State struct {
 	Database      *sql.DB
 	Renderer      *glamour.TermRenderer
 	Logger        *slog.Logger
-	FileName string
+	FileName      string
+	// FileRoot is the only directory FileName can be in when it is set, web
+	// sessions can only use the files uploaded to them.
+	FileRoot       string
+	Cipher         *MemoryCipher
+	Config         Config
+	Profile        string
+	User           string
+	RoutedMode     OperatingMode
+	ToolCalls      []ToolCall
+	MCPConnections []*MCPConnection
 }
 
-func NewState(settings Settings, database *sql.DB, logFile *os.File) *State {
+func newRenderer() *glamour.TermRenderer {
 	r, _ := glamour.NewTermRenderer(
 		glamour.WithAutoStyle(),
 		glamour.WithWordWrap(-1),
 	)
+	return r
+}
 
+func NewState(settings Settings, database *sql.DB, memoryCipher *MemoryCipher, logFile *os.File) *State {
 	logger := slog.New(slog.NewTextHandler(logFile, &slog.HandlerOptions{
 		Level:     slog.LevelInfo,
 		AddSource: true,
@@ -32,10 +47,40 @@ func NewState(settings Settings, database *sql.DB, logFile *os.File) *State {
 
 	return &State{
 		Settings:      settings,
-		OperatingMode: Search,
+		OperatingMode: settings.DefaultMode,
 		Remember:      true,
 		Database:      database,
-		Renderer:      r,
+		Cipher:        memoryCipher,
+		Renderer:      newRenderer(),
 		Logger:        logger,
 	}
 }
+
+// resolveFile turns a file name into the path to use as FileName, names in a
+// web session are uploads and anything outside its uploads is refused.
+func resolveFile(state *State, name string) (string, error) {
+	if name == "" || state.FileRoot == "" {
+		return name, nil
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(state.FileRoot, name)
+	}
+	if filepath.Dir(filepath.Clean(name)) != filepath.Clean(state.FileRoot) {
+		return "", errors.New("only files uploaded to this session can be used")
+	}
+	return filepath.Clean(name), nil
+}
+
+// readFile reads FileName, checking it again since a regenerated interaction
+// brings back the file it was answered with. Uploads are decrypted.
+func readFile(state *State) ([]byte, error) {
+	path, err := resolveFile(state, state.FileName)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil || state.FileRoot == "" {
+		return content, err
+	}
+	return state.Cipher.Open(content)
+}
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestResolveFile(t *testing.T) {
+	state := &State{FileRoot: "/data/.uploads/session"}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"", ""},
+		{"notes.txt", "/data/.uploads/session/notes.txt"},
+		{"./notes.txt", "/data/.uploads/session/notes.txt"},
+		{"/data/.uploads/session/notes.txt", "/data/.uploads/session/notes.txt"},
+		{"/data/.uploads/other/../session/notes.txt", "/data/.uploads/session/notes.txt"},
+	}
+	for _, test := range tests {
+		got, err := resolveFile(state, test.name)
+		if err != nil {
+			t.Errorf("resolveFile(%q) returned error %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("resolveFile(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestResolveFileErrors(t *testing.T) {
+	state := &State{FileRoot: "/data/.uploads/session"}
+	tests := []string{
+		"/etc/passwd",
+		"../other/notes.txt",
+		"../../.memories.db",
+		"sub/notes.txt",
+		"/data/.uploads/session",
+		"/data/.uploads/session-other/notes.txt",
+		"/data/.uploads/session/../session-other/notes.txt",
+	}
+	for _, name := range tests {
+		if got, err := resolveFile(state, name); err == nil {
+			t.Errorf("resolveFile(%q) = %q, want an error", name, got)
+		}
+	}
+}
+
+func TestResolveFileWithoutRoot(t *testing.T) {
+	state := &State{}
+	for _, name := range []string{"notes.txt", "../notes.txt", "/etc/hosts"} {
+		got, err := resolveFile(state, name)
+		if err != nil || got != name {
+			t.Errorf("resolveFile(%q) = %q, %v, want %q", name, got, err, name)
+		}
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata"
+	"unicode"
+)
+
+type CalculateArguments struct {
+	Expression string `json:"expression" jsonschema:"description=Arithmetic expression like (3 + 4) * 2 ^ 10 / sqrt(2)"`
+}
+type ConvertUnitsArguments struct {
+	Value float64 `json:"value"`
+	From  string  `json:"from" jsonschema:"description=Unit to convert from like km, lb, F, GiB or mph"`
+	To    string  `json:"to" jsonschema:"description=Unit to convert to"`
+}
+type DateArguments struct {
+	Operation  string `json:"operation" jsonschema:"enum=now,enum=difference,enum=add,enum=convert,description=now gives the current time, difference the time from date to other_date or from now until date when other_date is empty, add adds amount units to date and convert moves date from timezone to to_timezone"`
+	Date       string `json:"date,omitempty" jsonschema:"description=Date like 2025-03-14 or 2025-03-14 15:04, empty means now"`
+	OtherDate  string `json:"other_date,omitempty" jsonschema:"description=Second date of difference, empty counts from now until date"`
+	Amount     int    `json:"amount,omitempty" jsonschema:"description=How many units add adds, negative to go back"`
+	Unit       string `json:"unit,omitempty" jsonschema:"enum=minutes,enum=hours,enum=days,enum=weeks,enum=months,enum=years"`
+	Timezone   string `json:"timezone,omitempty" jsonschema:"description=IANA timezone of the dates like Europe/Paris, defaults to the local timezone"`
+	ToTimezone string `json:"to_timezone,omitempty" jsonschema:"description=IANA timezone convert moves the date to"`
+}
+
+// builtinTools are deterministic tools every mode's final answer can call,
+// small models are bad at arithmetic and dates.
+var builtinTools = []AgentTool{
+	{
+		Name:        "calculate",
+		Description: "Evaluate an arithmetic expression, use it instead of calculating yourself. Supports + - * / % ^, parentheses, pi, e and sqrt, abs, round, floor, ceil, exp, ln, log, log2, sin, cos, tan, min, max",
+		Arguments:   &CalculateArguments{},
+		Run: func(state *State, client *http.Client, arguments json.RawMessage) (string, error) {
+			calculation := CalculateArguments{}
+			if err := json.Unmarshal(arguments, &calculation); err != nil {
+				return "", err
+			}
+			result, err := evaluateExpression(calculation.Expression)
+			if err != nil {
+				return "", err
+			}
+			return formatNumber(result), nil
+		},
+	},
+	{
+		Name:        "convert_units",
+		Description: "Convert a value between units of length, mass, volume, area, speed, time, data or temperature",
+		Arguments:   &ConvertUnitsArguments{},
+		Run: func(state *State, client *http.Client, arguments json.RawMessage) (string, error) {
+			conversion := ConvertUnitsArguments{}
+			if err := json.Unmarshal(arguments, &conversion); err != nil {
+				return "", err
+			}
+			result, err := convertUnits(conversion.Value, conversion.From, conversion.To)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s %s = %s %s", formatNumber(conversion.Value), conversion.From, formatNumber(result), conversion.To), nil
+		},
+	},
+	{
+		Name:        "date",
+		Description: "Get the current date and time, count the days between dates, add time to a date or convert a time between timezones",
+		Arguments:   &DateArguments{},
+		Run: func(state *State, client *http.Client, arguments json.RawMessage) (string, error) {
+			date := DateArguments{}
+			if err := json.Unmarshal(arguments, &date); err != nil {
+				return "", err
+			}
+			return calculateDate(date, time.Now())
+		},
+	},
+}
+
+func formatNumber(value float64) string {
+	if value == math.Trunc(value) && math.Abs(value) < 1e15 {
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(value, 'g', 12, 64)
+}
+
+var expressionConstants = map[string]float64{
+	"pi": math.Pi,
+	"e":  math.E,
+}
+
+var expressionFunctions = map[string]func(arguments []float64) (float64, error){
+	"sqrt":  oneArgument(math.Sqrt),
+	"abs":   oneArgument(math.Abs),
+	"round": oneArgument(math.Round),
+	"floor": oneArgument(math.Floor),
+	"ceil":  oneArgument(math.Ceil),
+	"exp":   oneArgument(math.Exp),
+	"ln":    oneArgument(math.Log),
+	"log":   oneArgument(math.Log10),
+	"log2":  oneArgument(math.Log2),
+	"sin":   oneArgument(math.Sin),
+	"cos":   oneArgument(math.Cos),
+	"tan":   oneArgument(math.Tan),
+	"min": func(arguments []float64) (float64, error) {
+		if len(arguments) == 0 {
+			return 0, fmt.Errorf("min needs at least one argument")
+		}
+		return slices.Min(arguments), nil
+	},
+	"max": func(arguments []float64) (float64, error) {
+		if len(arguments) == 0 {
+			return 0, fmt.Errorf("max needs at least one argument")
+		}
+		return slices.Max(arguments), nil
+	},
+}
+
+func oneArgument(function func(float64) float64) func(arguments []float64) (float64, error) {
+	return func(arguments []float64) (float64, error) {
+		if len(arguments) != 1 {
+			return 0, fmt.Errorf("expected one argument, got %d", len(arguments))
+		}
+		return function(arguments[0]), nil
+	}
+}
+
+// expressionParser is a recursive descent parser for
+//
+//	expression = term {("+" | "-") term}
+//	term       = unary {("*" | "/" | "%") unary}
+//	unary      = ("-" | "+") unary | power
+//	power      = primary ["^" unary]
+//	primary    = number | constant | function "(" [expression {"," expression}] ")" | "(" expression ")"
+type expressionParser struct {
+	tokens   []string
+	position int
+}
+
+func tokenizeExpression(expression string) ([]string, error) {
+	var tokens []string
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case unicode.IsDigit(r) || r == '.':
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.' || runes[i] == '_') {
+				i++
+			}
+			// Scientific notation like 1.5e-3.
+			if i+1 < len(runes) && (runes[i] == 'e' || runes[i] == 'E') {
+				exponent := i + 1
+				if runes[exponent] == '-' || runes[exponent] == '+' {
+					exponent++
+				}
+				if exponent < len(runes) && unicode.IsDigit(runes[exponent]) {
+					for i = exponent; i < len(runes) && unicode.IsDigit(runes[i]); i++ {
+					}
+				}
+			}
+			tokens = append(tokens, strings.ReplaceAll(string(runes[start:i]), "_", ""))
+		case unicode.IsLetter(r):
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i])) {
+				i++
+			}
+			tokens = append(tokens, strings.ToLower(string(runes[start:i])))
+		case strings.ContainsRune("+-*/%^(),", r):
+			tokens = append(tokens, string(r))
+			i++
+		case r == '×':
+			tokens = append(tokens, "*")
+			i++
+		case r == '÷':
+			tokens = append(tokens, "/")
+			i++
+		default:
+			return nil, fmt.Errorf("unexpected %q in expression", r)
+		}
+	}
+	return tokens, nil
+}
+
+func evaluateExpression(expression string) (float64, error) {
+	tokens, err := tokenizeExpression(expression)
+	if err != nil {
+		return 0, err
+	}
+	parser := &expressionParser{tokens: tokens}
+	result, err := parser.expression()
+	if err != nil {
+		return 0, err
+	}
+	if parser.position < len(parser.tokens) {
+		return 0, fmt.Errorf("unexpected %s in expression", parser.tokens[parser.position])
+	}
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, fmt.Errorf("the result isn't a number")
+	}
+	return result, nil
+}
+
+func (self *expressionParser) peek() string {
+	if self.position < len(self.tokens) {
+		return self.tokens[self.position]
+	}
+	return ""
+}
+
+func (self *expressionParser) next() string {
+	token := self.peek()
+	self.position++
+	return token
+}
+
+func (self *expressionParser) expression() (float64, error) {
+	result, err := self.term()
+	if err != nil {
+		return 0, err
+	}
+	for self.peek() == "+" || self.peek() == "-" {
+		operator := self.next()
+		right, err := self.term()
+		if err != nil {
+			return 0, err
+		}
+		if operator == "+" {
+			result += right
+		} else {
+			result -= right
+		}
+	}
+	return result, nil
+}
+
+func (self *expressionParser) term() (float64, error) {
+	result, err := self.unary()
+	if err != nil {
+		return 0, err
+	}
+	for self.peek() == "*" || self.peek() == "/" || self.peek() == "%" {
+		operator := self.next()
+		right, err := self.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch operator {
+		case "*":
+			result *= right
+		case "/":
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			result /= right
+		case "%":
+			if right == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			result = math.Mod(result, right)
+		}
+	}
+	return result, nil
+}
+
+func (self *expressionParser) unary() (float64, error) {
+	switch self.peek() {
+	case "-":
+		self.next()
+		result, err := self.unary()
+		return -result, err
+	case "+":
+		self.next()
+		return self.unary()
+	}
+	return self.power()
+}
+
+func (self *expressionParser) power() (float64, error) {
+	base, err := self.primary()
+	if err != nil {
+		return 0, err
+	}
+	if self.peek() != "^" {
+		return base, nil
+	}
+	self.next()
+	exponent, err := self.unary()
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(base, exponent), nil
+}
+
+func (self *expressionParser) primary() (float64, error) {
+	token := self.next()
+	switch {
+	case token == "":
+		return 0, fmt.Errorf("unexpected end of expression")
+	case token == "(":
+		result, err := self.expression()
+		if err != nil {
+			return 0, err
+		}
+		if self.next() != ")" {
+			return 0, fmt.Errorf("missing )")
+		}
+		return result, nil
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		return strconv.ParseFloat(token, 64)
+	}
+
+	if value, ok := expressionConstants[token]; ok {
+		return value, nil
+	}
+	function, ok := expressionFunctions[token]
+	if !ok {
+		return 0, fmt.Errorf("unknown name %s", token)
+	}
+	if self.next() != "(" {
+		return 0, fmt.Errorf("%s needs (", token)
+	}
+	var arguments []float64
+	for self.peek() != ")" {
+		argument, err := self.expression()
+		if err != nil {
+			return 0, err
+		}
+		arguments = append(arguments, argument)
+		if self.peek() == "," {
+			self.next()
+		} else if self.peek() != ")" {
+			return 0, fmt.Errorf("missing ) after the arguments of %s", token)
+		}
+	}
+	self.next()
+	return function(arguments)
+}
+
+type unit struct {
+	Category string
+	// Factor converts the unit to the base unit of its category.
+	Factor float64
+}
+
+var units = map[string]unit{
+	"m":     {"length", 1},
+	"km":    {"length", 1000},
+	"cm":    {"length", 0.01},
+	"mm":    {"length", 0.001},
+	"um":    {"length", 1e-6},
+	"nm":    {"length", 1e-9},
+	"mi":    {"length", 1609.344},
+	"yd":    {"length", 0.9144},
+	"ft":    {"length", 0.3048},
+	"in":    {"length", 0.0254},
+	"nmi":   {"length", 1852},
+	"kg":    {"mass", 1},
+	"g":     {"mass", 0.001},
+	"mg":    {"mass", 1e-6},
+	"t":     {"mass", 1000},
+	"lb":    {"mass", 0.45359237},
+	"oz":    {"mass", 0.028349523125},
+	"st":    {"mass", 6.35029318},
+	"l":     {"volume", 1},
+	"ml":    {"volume", 0.001},
+	"m3":    {"volume", 1000},
+	"gal":   {"volume", 3.785411784},
+	"qt":    {"volume", 0.946352946},
+	"pt":    {"volume", 0.473176473},
+	"cup":   {"volume", 0.2365882365},
+	"floz":  {"volume", 0.0295735295625},
+	"tbsp":  {"volume", 0.01478676478125},
+	"tsp":   {"volume", 0.00492892159375},
+	"m2":    {"area", 1},
+	"km2":   {"area", 1e6},
+	"cm2":   {"area", 1e-4},
+	"ha":    {"area", 1e4},
+	"acre":  {"area", 4046.8564224},
+	"ft2":   {"area", 0.09290304},
+	"in2":   {"area", 0.00064516},
+	"mi2":   {"area", 2589988.110336},
+	"m/s":   {"speed", 1},
+	"km/h":  {"speed", 1 / 3.6},
+	"mph":   {"speed", 0.44704},
+	"kn":    {"speed", 1852.0 / 3600},
+	"s":     {"time", 1},
+	"ms":    {"time", 0.001},
+	"min":   {"time", 60},
+	"h":     {"time", 3600},
+	"d":     {"time", 86400},
+	"wk":    {"time", 604800},
+	"yr":    {"time", 31557600},
+	"bit":   {"data", 0.125},
+	"byte":  {"data", 1},
+	"kb":    {"data", 1e3},
+	"mb":    {"data", 1e6},
+	"gb":    {"data", 1e9},
+	"tb":    {"data", 1e12},
+	"kib":   {"data", 1 << 10},
+	"mib":   {"data", 1 << 20},
+	"gib":   {"data", 1 << 30},
+	"tib":   {"data", 1 << 40},
+	"c":     {"temperature", 0},
+	"f":     {"temperature", 0},
+	"k":     {"temperature", 0},
+	"mpg":   {"fuel", 0},
+	"l/100": {"fuel", 0},
+}
+
+var unitAliases = map[string]string{
+	"meter": "m", "metre": "m", "meters": "m", "metres": "m",
+	"kilometer": "km", "kilometre": "km", "kilometers": "km", "kilometres": "km",
+	"centimeter": "cm", "centimeters": "cm", "millimeter": "mm", "millimeters": "mm",
+	"mile": "mi", "miles": "mi", "yard": "yd", "yards": "yd",
+	"foot": "ft", "feet": "ft", "inch": "in", "inches": "in",
+	"kilogram": "kg", "kilograms": "kg", "kgs": "kg", "gram": "g", "grams": "g",
+	"tonne": "t", "tonnes": "t", "pound": "lb", "pounds": "lb", "lbs": "lb",
+	"ounce": "oz", "ounces": "oz", "stone": "st",
+	"liter": "l", "litre": "l", "liters": "l", "litres": "l", "milliliter": "ml", "milliliters": "ml",
+	"gallon": "gal", "gallons": "gal", "quart": "qt", "pint": "pt", "cups": "cup",
+	"fl oz": "floz", "tablespoon": "tbsp", "teaspoon": "tsp",
+	"acres": "acre", "hectare": "ha", "hectares": "ha",
+	"kph": "km/h", "kmh": "km/h", "knots": "kn", "knot": "kn",
+	"second": "s", "seconds": "s", "sec": "s", "minute": "min", "minutes": "min",
+	"hour": "h", "hours": "h", "day": "d", "days": "d", "week": "wk", "weeks": "wk",
+	"year": "yr", "years": "yr", "bits": "bit", "bytes": "byte", "b": "byte",
+	"celsius": "c", "°c": "c", "fahrenheit": "f", "°f": "f", "kelvin": "k",
+	"l/100km": "l/100",
+}
+
+func lookupUnit(name string) (string, unit, bool) {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if alias, ok := unitAliases[key]; ok {
+		key = alias
+	}
+	found, ok := units[key]
+	return key, found, ok
+}
+
+func convertUnits(value float64, from string, to string) (float64, error) {
+	fromKey, fromUnit, ok := lookupUnit(from)
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %s", from)
+	}
+	toKey, toUnit, ok := lookupUnit(to)
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %s", to)
+	}
+	if fromUnit.Category != toUnit.Category {
+		return 0, fmt.Errorf("can't convert %s (%s) to %s (%s)", from, fromUnit.Category, to, toUnit.Category)
+	}
+
+	switch fromUnit.Category {
+	case "temperature":
+		celsius := value
+		switch fromKey {
+		case "f":
+			celsius = (value - 32) * 5 / 9
+		case "k":
+			celsius = value - 273.15
+		}
+		switch toKey {
+		case "f":
+			return celsius*9/5 + 32, nil
+		case "k":
+			return celsius + 273.15, nil
+		}
+		return celsius, nil
+	case "fuel":
+		// Miles per gallon and liters per 100km are inverse to each other.
+		if fromKey == toKey {
+			return value, nil
+		}
+		if value == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return 100 * units["gal"].Factor / (units["mi"].Factor / 1000) / value, nil
+	}
+	return value * fromUnit.Factor / toUnit.Factor, nil
+}
+
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+const dateOutputLayout = "Monday 2006-01-02 15:04 MST"
+
+// parseDate parses date in location, it returns whether the date had a time
+// of day in it.
+func parseDate(date string, location *time.Location, now time.Time) (time.Time, bool, error) {
+	date = strings.TrimSpace(date)
+	if date == "" || strings.EqualFold(date, "now") {
+		return now.In(location), true, nil
+	}
+	if strings.EqualFold(date, "today") {
+		year, month, day := now.In(location).Date()
+		return time.Date(year, month, day, 0, 0, 0, 0, location), false, nil
+	}
+	for _, layout := range dateLayouts {
+		if parsed, err := time.ParseInLocation(layout, date, location); err == nil {
+			return parsed, layout != "2006-01-02", nil
+		}
+	}
+	return time.Time{}, false, fmt.Errorf("can't read the date %s, use 2006-01-02 or 2006-01-02 15:04", date)
+}
+
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// addMonths stays on the last day of the month instead of spilling into the
+// next one, January 31st plus a month is February 28th.
+func addMonths(date time.Time, months int) time.Time {
+	firstOfMonth := time.Date(date.Year(), date.Month()+time.Month(months), 1, date.Hour(), date.Minute(), date.Second(), date.Nanosecond(), date.Location())
+	lastDay := firstOfMonth.AddDate(0, 1, -1).Day()
+	return firstOfMonth.AddDate(0, 0, min(date.Day(), lastDay)-1)
+}
+
+func calculateDate(arguments DateArguments, now time.Time) (string, error) {
+	location, err := loadTimezone(arguments.Timezone)
+	if err != nil {
+		return "", err
+	}
+	date, hasTime, err := parseDate(arguments.Date, location, now)
+	if err != nil {
+		return "", err
+	}
+
+	switch arguments.Operation {
+	case "now":
+		return now.In(location).Format(dateOutputLayout), nil
+	case "difference":
+		other, otherHasTime, err := parseDate(arguments.OtherDate, location, now)
+		if err != nil {
+			return "", err
+		}
+		// With one date the question is how long until it, or since it when
+		// the result is negative.
+		if strings.TrimSpace(arguments.OtherDate) == "" {
+			date, other, hasTime, otherHasTime = other, date, otherHasTime, hasTime
+		}
+		if !hasTime || !otherHasTime {
+			// Count calendar days so daylight saving doesn't get in the way.
+			from := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+			to := time.Date(other.Year(), other.Month(), other.Day(), 0, 0, 0, 0, time.UTC)
+			days := int(to.Sub(from).Hours() / 24)
+			return fmt.Sprintf("%d days (%d weeks and %d days) from %s to %s", days, days/7, days%7, from.Format("Monday 2006-01-02"), to.Format("Monday 2006-01-02")), nil
+		}
+		difference := other.Sub(date)
+		days := int(difference.Hours() / 24)
+		rest := difference - time.Duration(days)*24*time.Hour
+		return fmt.Sprintf("%d days %s (%s) from %s to %s", days, rest.Round(time.Minute), difference.Round(time.Minute), date.Format(dateOutputLayout), other.Format(dateOutputLayout)), nil
+	case "add":
+		var result time.Time
+		switch arguments.Unit {
+		case "minutes":
+			result = date.Add(time.Duration(arguments.Amount) * time.Minute)
+		case "hours":
+			result = date.Add(time.Duration(arguments.Amount) * time.Hour)
+		case "days", "":
+			result = date.AddDate(0, 0, arguments.Amount)
+		case "weeks":
+			result = date.AddDate(0, 0, 7*arguments.Amount)
+		case "months":
+			result = addMonths(date, arguments.Amount)
+		case "years":
+			result = addMonths(date, 12*arguments.Amount)
+		default:
+			return "", fmt.Errorf("unknown unit %s", arguments.Unit)
+		}
+		if !hasTime {
+			return result.Format("Monday 2006-01-02"), nil
+		}
+		return result.Format(dateOutputLayout), nil
+	case "convert":
+		target, err := loadTimezone(arguments.ToTimezone)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s is %s", date.Format(dateOutputLayout), date.In(target).Format(dateOutputLayout)), nil
+	}
+	return "", fmt.Errorf("unknown operation %s", arguments.Operation)
+}
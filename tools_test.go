@@ -0,0 +1,258 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestEvaluateExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       float64
+	}{
+		{"1 + 2", 3},
+		{"2 + 3 * 4", 14},
+		{"(2 + 3) * 4", 20},
+		{"10 - 4 - 3", 3},
+		{"100 / 10 / 2", 5},
+		{"7 % 3", 1},
+		{"2 ^ 10", 1024},
+		{"2 ^ 3 ^ 2", 512},
+		{"-2 ^ 2", -4},
+		{"2 ^ -1", 0.5},
+		{"--3", 3},
+		{"+4", 4},
+		{"1.5e3", 1500},
+		{"1.5E-3 * 1000", 1.5},
+		{"1_000_000 / 1000", 1000},
+		{".5 + .25", 0.75},
+		{"3 × 4 ÷ 2", 6},
+		{"sqrt(16) + abs(-2)", 6},
+		{"round(2.5) + floor(2.7) + ceil(2.1)", 8},
+		{"log(1000) + log2(8) + ln(e)", 7},
+		{"min(3, 1, 2) + max(3, 1, 2)", 4},
+		{"SQRT(9)", 3},
+		{"cos(pi)", -1},
+		{"max(1 + 1, 2 * 3)", 6},
+	}
+	for _, test := range tests {
+		got, err := evaluateExpression(test.expression)
+		if err != nil {
+			t.Errorf("evaluateExpression(%q) returned error %v", test.expression, err)
+			continue
+		}
+		if math.Abs(got-test.want) > 1e-9 {
+			t.Errorf("evaluateExpression(%q) = %v, want %v", test.expression, got, test.want)
+		}
+	}
+}
+
+func TestEvaluateExpressionErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"1 +",
+		"1 / 0",
+		"5 % 0",
+		"(1 + 2",
+		"1 + 2)",
+		"2 3",
+		"foo(1)",
+		"x + 1",
+		"sqrt 4",
+		"sqrt(1, 2)",
+		"min()",
+		"sqrt(-1)",
+		"1 $ 2",
+		"max(1 2)",
+	}
+	for _, expression := range tests {
+		if got, err := evaluateExpression(expression); err == nil {
+			t.Errorf("evaluateExpression(%q) = %v, want an error", expression, got)
+		}
+	}
+}
+
+func TestFormatNumber(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  string
+	}{
+		{3, "3"},
+		{-42, "-42"},
+		{0.5, "0.5"},
+		{1.0 / 3, "0.333333333333"},
+		{1e20, "1e+20"},
+	}
+	for _, test := range tests {
+		if got := formatNumber(test.value); got != test.want {
+			t.Errorf("formatNumber(%v) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestConvertUnits(t *testing.T) {
+	tests := []struct {
+		value float64
+		from  string
+		to    string
+		want  float64
+	}{
+		{1, "km", "m", 1000},
+		{1, "mile", "km", 1.609344},
+		{12, "in", "ft", 1},
+		{1, "kg", "lb", 2.2046226218},
+		{16, "oz", "lb", 1},
+		{1, "gal", "l", 3.785411784},
+		{1, "ha", "m2", 10000},
+		{36, "km/h", "m/s", 10},
+		{60, "mph", "km/h", 96.56064},
+		{2, "hours", "min", 120},
+		{1, "GiB", "MiB", 1024},
+		{8, "bit", "byte", 1},
+		{100, "C", "F", 212},
+		{32, "fahrenheit", "celsius", 0},
+		{0, "K", "C", -273.15},
+		{-40, "°F", "°C", -40},
+		{30, "mpg", "l/100km", 7.8404839},
+		{7.8404839, "l/100", "mpg", 30},
+		{5, " Meters ", "m", 5},
+	}
+	for _, test := range tests {
+		got, err := convertUnits(test.value, test.from, test.to)
+		if err != nil {
+			t.Errorf("convertUnits(%v, %q, %q) returned error %v", test.value, test.from, test.to, err)
+			continue
+		}
+		if math.Abs(got-test.want) > 1e-6*math.Max(1, math.Abs(test.want)) {
+			t.Errorf("convertUnits(%v, %q, %q) = %v, want %v", test.value, test.from, test.to, got, test.want)
+		}
+	}
+}
+
+func TestConvertUnitsErrors(t *testing.T) {
+	tests := []struct {
+		value float64
+		from  string
+		to    string
+	}{
+		{1, "km", "kg"},
+		{1, "furlong", "m"},
+		{1, "m", "parsec"},
+		{1, "C", "m"},
+		{0, "mpg", "l/100"},
+	}
+	for _, test := range tests {
+		if got, err := convertUnits(test.value, test.from, test.to); err == nil {
+			t.Errorf("convertUnits(%v, %q, %q) = %v, want an error", test.value, test.from, test.to, got)
+		}
+	}
+}
+
+func TestAddMonths(t *testing.T) {
+	tests := []struct {
+		date   string
+		months int
+		want   string
+	}{
+		{"2025-01-31", 1, "2025-02-28"},
+		{"2024-01-31", 1, "2024-02-29"},
+		{"2025-03-31", -1, "2025-02-28"},
+		{"2025-01-15", 1, "2025-02-15"},
+		{"2025-11-30", 3, "2026-02-28"},
+		{"2024-02-29", 12, "2025-02-28"},
+	}
+	for _, test := range tests {
+		date, _ := time.Parse("2006-01-02", test.date)
+		if got := addMonths(date, test.months).Format("2006-01-02"); got != test.want {
+			t.Errorf("addMonths(%s, %d) = %s, want %s", test.date, test.months, got, test.want)
+		}
+	}
+}
+
+func TestCalculateDate(t *testing.T) {
+	now := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		arguments DateArguments
+		want      string
+	}{
+		{
+			"now",
+			DateArguments{Operation: "now", Timezone: "UTC"},
+			"Sunday 2026-10-18 09:30 UTC",
+		},
+		{
+			"days until a date",
+			DateArguments{Operation: "difference", Date: "2026-12-25", Timezone: "UTC"},
+			"68 days (9 weeks and 5 days) from Sunday 2026-10-18 to Friday 2026-12-25",
+		},
+		{
+			"days since a date",
+			DateArguments{Operation: "difference", Date: "2026-10-01", Timezone: "UTC"},
+			"-17 days (-2 weeks and -3 days) from Sunday 2026-10-18 to Thursday 2026-10-01",
+		},
+		{
+			"days between two dates",
+			DateArguments{Operation: "difference", Date: "2026-01-01", OtherDate: "2026-03-01", Timezone: "UTC"},
+			"59 days (8 weeks and 3 days) from Thursday 2026-01-01 to Sunday 2026-03-01",
+		},
+		{
+			"time until a date and time",
+			DateArguments{Operation: "difference", Date: "2026-10-20 12:00", Timezone: "UTC"},
+			"2 days 2h30m0s (50h30m0s) from Sunday 2026-10-18 09:30 UTC to Tuesday 2026-10-20 12:00 UTC",
+		},
+		{
+			"difference across daylight saving",
+			DateArguments{Operation: "difference", Date: "2026-03-28", OtherDate: "2026-03-30", Timezone: "Europe/Paris"},
+			"2 days (0 weeks and 2 days) from Saturday 2026-03-28 to Monday 2026-03-30",
+		},
+		{
+			"add days",
+			DateArguments{Operation: "add", Date: "2026-10-18", Amount: 100, Timezone: "UTC"},
+			"Tuesday 2027-01-26",
+		},
+		{
+			"add months at the end of a month",
+			DateArguments{Operation: "add", Date: "2026-01-31", Amount: 1, Unit: "months", Timezone: "UTC"},
+			"Saturday 2026-02-28",
+		},
+		{
+			"add hours to now",
+			DateArguments{Operation: "add", Amount: -3, Unit: "hours", Timezone: "UTC"},
+			"Sunday 2026-10-18 06:30 UTC",
+		},
+		{
+			"convert timezones",
+			DateArguments{Operation: "convert", Date: "2026-10-18 15:00", Timezone: "Europe/Paris", ToTimezone: "America/New_York"},
+			"Sunday 2026-10-18 15:00 CEST is Sunday 2026-10-18 09:00 EDT",
+		},
+	}
+	for _, test := range tests {
+		got, err := calculateDate(test.arguments, now)
+		if err != nil {
+			t.Errorf("%s: calculateDate returned error %v", test.name, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: calculateDate = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCalculateDateErrors(t *testing.T) {
+	now := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+	tests := []DateArguments{
+		{Operation: "difference", Date: "next tuesday"},
+		{Operation: "difference", Date: "2026-12-25", OtherDate: "25/12/2026"},
+		{Operation: "add", Date: "2026-10-18", Amount: 1, Unit: "fortnights"},
+		{Operation: "now", Timezone: "Mars/Olympus_Mons"},
+		{Operation: "convert", Date: "2026-10-18", ToTimezone: "Nowhere/Town"},
+		{Operation: "subtract"},
+	}
+	for _, arguments := range tests {
+		if got, err := calculateDate(arguments, now); err == nil {
+			t.Errorf("calculateDate(%+v) = %q, want an error", arguments, got)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"html/template"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const tlsDirectoryName string = ".tls"
+
+// selfSignedValidity is how long a generated certificate is valid, it is
+// generated again once it expires.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// basePathContextKey is where the web server keeps the path it is served
+// under.
+const basePathContextKey = "base_path"
+
+// WebInteraction is an interaction as the chat thread of the web UI shows it.
+type WebInteraction struct {
+	Question  string
+	Answer    template.HTML
+	Sources   []string
+	Mode      string
+	Model     string
+	Timestamp string
+	File      string
+	ToolCalls []ToolCall
+	// Saved is false for answers that aren't remembered.
+	Saved bool
+}
+
+// WebNotice is the output of a command or an answer that isn't part of the
+// memory, shown after the thread.
+type WebNotice struct {
+	Question string
+	Answer   template.HTML
+}
+
+func newWebInteraction(interaction ChatInteraction, saved bool) WebInteraction {
+	timestamp := ""
+	if !interaction.Timestamp.IsZero() {
+		timestamp = interaction.Timestamp.In(time.Local).Format("2006-01-02 15:04")
+	}
+	return WebInteraction{
+		Question:  interaction.Question,
+		Answer:    template.HTML(toHTML(interaction.Answer)),
+		Sources:   interaction.Links,
+		Mode:      interaction.GetModeName(),
+		Model:     interaction.Model,
+		Timestamp: timestamp,
+		File:      displayFileName(interaction.FileName),
+		ToolCalls: interaction.ToolCalls,
+		Saved:     saved,
+	}
+}
+
+// displayFileName hides where uploads are kept on the server, they are shown
+// by the name they were uploaded with.
+func displayFileName(path string) string {
+	if strings.Contains(path, string(filepath.Separator)+uploadsDirectoryName+string(filepath.Separator)) {
+		return filepath.Base(path)
+	}
+	return path
+}
+
+func getWebThread(state *State) []WebInteraction {
+	thread := make([]WebInteraction, 0, len(state.Memory.Interactions))
+	for _, interaction := range state.Memory.Interactions {
+		thread = append(thread, newWebInteraction(interaction, true))
+	}
+	return thread
+}
+
+// normalizeBasePath turns "yaap/" and "/yaap" into "/yaap" and "/" into "".
+func normalizeBasePath(basePath string) string {
+	basePath = strings.Trim(basePath, "/")
+	if basePath == "" {
+		return ""
+	}
+	return "/" + basePath
+}
+
+// webPath is path under the base path of the web server.
+func webPath(c *gin.Context, path string) string {
+	return c.GetString(basePathContextKey) + path
+}
+
+// cookiePath is the path the cookies of the web server are scoped to.
+func cookiePath(c *gin.Context) string {
+	if basePath := c.GetString(basePathContextKey); basePath != "" {
+		return basePath
+	}
+	return "/"
+}
+
+// isSecureRequest reports whether the browser talks HTTPS to us or to the
+// reverse proxy in front of us, so cookies are only sent over HTTPS.
+func isSecureRequest(c *gin.Context) bool {
+	return c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+}
+
+// parseTrustedProxies splits a comma separated list of proxy addresses or
+// networks, no proxies means the client address is never taken from headers.
+func parseTrustedProxies(proxies string) []string {
+	var trusted []string
+	for _, proxy := range strings.Split(proxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trusted = append(trusted, proxy)
+		}
+	}
+	return trusted
+}
+
+// selfSignedCertificate returns the paths of a self-signed certificate and
+// its key in the data directory, generating them if they are missing or
+// expired.
+func selfSignedCertificate(dataDir string) (string, string, error) {
+	directory := filepath.Join(dataDir, tlsDirectoryName)
+	certPath := filepath.Join(directory, "cert.pem")
+	keyPath := filepath.Join(directory, "key.pem")
+	if certificate, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil && time.Now().Before(certificate.Leaf.NotAfter) {
+		return certPath, keyPath, nil
+	}
+
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return "", "", err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"YAAP"}, CommonName: "YAAP"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(selfSignedValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname, hostname+".local")
+	}
+	// Every address of the machine so phones on the LAN can use its IP.
+	addresses, _ := net.InterfaceAddrs()
+	for _, address := range addresses {
+		if network, ok := address.(*net.IPNet); ok {
+			template.IPAddresses = append(template.IPAddresses, network.IP)
+		}
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	encodedKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate}), 0644); err != nil {
+		return "", "", err
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: encodedKey}), 0600); err != nil {
+		return "", "", err
+	}
+	fmt.Printf("Generated a self-signed certificate in %s, browsers will warn about it until you trust it\n", certPath)
+	return certPath, keyPath, nil
+}